@@ -1,25 +1,91 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/Siddheshk02/coupon-system/internal/config"
 	"github.com/Siddheshk02/coupon-system/internal/db"
 	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/throttle"
 )
 
 func main() {
 	config.Load()
 	db.Init(config.AppConfig)
 
-	couponRepo := repository.NewCouponRepository(db.Conn)
-	itemRepo := repository.NewItemRepository(db.Conn)
-	orderRepo := repository.NewOrderRepository(db.Conn)
+	couponRepo := repository.NewCouponRepository(db.Conn, repository.ApprovalPolicy{
+		MaxPercentage: config.AppConfig.ApprovalMaxPercentage,
+		RequireCap:    config.AppConfig.ApprovalRequireCap,
+		RequireBudget: config.AppConfig.ApprovalRequireBudget,
+	}, repository.AbusePolicy{
+		FlagLinkedAccounts:  config.AppConfig.AbuseFlagLinkedAccounts,
+		BlockLinkedAccounts: config.AppConfig.AbuseBlockLinkedAccounts,
+		FlagVelocity:        config.AppConfig.AbuseFlagVelocity,
+		Window:              config.AppConfig.AbuseWindow,
+	})
+	couponRepo.RejectOutOfStock = config.AppConfig.RejectOutOfStock
+	itemRepo := repository.NewItemRepository(db.Conn, config.AppConfig.ReservationTTL)
+	go pruneReservations(itemRepo)
+	categoryRepo := repository.NewCategoryRepository(db.Conn)
+	orderRepo := repository.NewOrderRepository(db.Conn, couponRepo)
+	orderRepo.IdempotencyRetention = config.AppConfig.IdempotencyRetention
 	userRepo := repository.NewUserRepository(db.Conn)
+	idempotencyRepo := repository.NewIdempotencyRepository(db.Conn, config.AppConfig.IdempotencyRetention)
+	go pruneIdempotencyKeys(idempotencyRepo)
 
-	r := RegisterRoutes(couponRepo, itemRepo, orderRepo, userRepo)
+	attempts := throttle.NewLimiter(newAttemptStore(), throttle.Policy{
+		FreeAttempts:    config.AppConfig.ThrottleFreeAttempts,
+		BaseDelay:       config.AppConfig.ThrottleBaseDelay,
+		MaxDelay:        config.AppConfig.ThrottleMaxDelay,
+		LockoutAfter:    config.AppConfig.ThrottleLockoutAfter,
+		LockoutDuration: config.AppConfig.ThrottleLockoutDuration,
+		Window:          config.AppConfig.ThrottleWindow,
+	})
+	if store, ok := attempts.Store.(*throttle.PostgresStore); ok {
+		go pruneAttempts(store, attempts.Policy.Retention())
+	}
+
+	r := RegisterRoutes(couponRepo, itemRepo, categoryRepo, orderRepo, userRepo, idempotencyRepo, attempts)
 
 	log.Printf("Server starting on port %s...", config.AppConfig.Port)
 	log.Fatal(http.ListenAndServe(":"+config.AppConfig.Port, r))
 }
+
+func newAttemptStore() throttle.Store {
+	if config.AppConfig.ThrottleStore == "postgres" {
+		return throttle.NewPostgresStore(db.Conn)
+	}
+	return throttle.NewMemoryStore()
+}
+
+// pruneAttempts periodically deletes failure records that can no longer
+// affect the backoff.
+func pruneAttempts(store *throttle.PostgresStore, retention time.Duration) {
+	for range time.Tick(10 * time.Minute) {
+		if err := store.Prune(context.Background(), time.Now().Add(-retention)); err != nil {
+			log.Printf("pruning failed attempts: %v", err)
+		}
+	}
+}
+
+// pruneIdempotencyKeys periodically deletes keys whose responses are no
+// longer replayed.
+func pruneIdempotencyKeys(repo *repository.IdempotencyRepository) {
+	for range time.Tick(10 * time.Minute) {
+		if err := repo.Prune(context.Background(), time.Now().Add(-repo.Retention)); err != nil {
+			log.Printf("pruning idempotency keys: %v", err)
+		}
+	}
+}
+
+// pruneReservations periodically deletes expired stock reservations.
+func pruneReservations(repo *repository.ItemRepository) {
+	for range time.Tick(10 * time.Minute) {
+		if err := repo.PruneReservations(context.Background(), time.Now()); err != nil {
+			log.Printf("pruning stock reservations: %v", err)
+		}
+	}
+}
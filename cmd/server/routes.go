@@ -2,26 +2,63 @@ package main
 
 import (
 	"github.com/Siddheshk02/coupon-system/internal/api/handlers"
+	"github.com/Siddheshk02/coupon-system/internal/config"
 	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/throttle"
 	"github.com/gorilla/mux"
 )
 
-func RegisterRoutes(couponRepo *repository.CouponRepository, itemRepo *repository.ItemRepository, orderRepo *repository.OrderRepository, userRepo *repository.UserRepository) *mux.Router {
+func RegisterRoutes(couponRepo *repository.CouponRepository, itemRepo *repository.ItemRepository, categoryRepo *repository.CategoryRepository, orderRepo *repository.OrderRepository, userRepo *repository.UserRepository, idempotencyRepo *repository.IdempotencyRepository, attempts *throttle.Limiter) *mux.Router {
 	router := mux.NewRouter()
 
-	couponHandler := handlers.NewCouponHandler(couponRepo)
+	couponHandler := handlers.NewCouponHandler(couponRepo, attempts, config.AppConfig.TrustForwardedFor)
 	itemHandler := handlers.NewItemHandler(itemRepo)
-	orderHandler := handlers.NewOrdersHandler(orderRepo)
+	categoryHandler := handlers.NewCategoryHandler(categoryRepo)
+	orderHandler := handlers.NewOrdersHandler(orderRepo, attempts, config.AppConfig.TrustForwardedFor)
 	userHandler := handlers.NewUserHandler(userRepo)
 
 	router.HandleFunc("/admin/coupons", couponHandler.CreateCoupon).Methods("POST")
+	router.HandleFunc("/admin/coupons", couponHandler.ListCoupons).Methods("GET")
+	router.HandleFunc("/admin/coupons/import", couponHandler.ImportCoupons).Methods("POST")
+	router.HandleFunc("/admin/coupons/export", couponHandler.ExportCoupons).Methods("GET")
+	router.HandleFunc("/admin/coupons/simulate", couponHandler.SimulateCoupon).Methods("POST")
+	router.HandleFunc("/admin/coupons/backtest", couponHandler.StartBacktest).Methods("POST")
+	router.HandleFunc("/admin/coupons/backtest/{id}", couponHandler.GetBacktest).Methods("GET")
+	router.HandleFunc("/admin/coupons/{code}", couponHandler.UpdateCoupon).Methods("PUT")
+	router.HandleFunc("/admin/coupons/{code}/history", couponHandler.GetCouponHistory).Methods("GET")
+	router.HandleFunc("/admin/coupons/{code}/status", couponHandler.TransitionCoupon).Methods("POST")
+	router.HandleFunc("/admin/coupons/{code}/transitions", couponHandler.GetCouponTransitions).Methods("GET")
+	router.HandleFunc("/admin/coupons/{code}/clone", couponHandler.CloneCoupon).Methods("POST")
+	router.HandleFunc("/admin/coupon-templates", couponHandler.SaveTemplate).Methods("POST")
+	router.HandleFunc("/admin/coupon-templates", couponHandler.GetTemplates).Methods("GET")
+	router.HandleFunc("/admin/coupon-templates/{name}/coupons", couponHandler.CreateFromTemplate).Methods("POST")
+	router.HandleFunc("/admin/coupons/{code}/assign", couponHandler.AssignCoupon).Methods("POST")
+	router.HandleFunc("/admin/redemptions/flagged", couponHandler.ListFlaggedRedemptions).Methods("GET")
+	router.HandleFunc("/admin/redemptions/flagged/{id}/review", couponHandler.ReviewRedemption).Methods("POST")
 	router.HandleFunc("/coupons/applicable", couponHandler.GetApplicableCoupons).Methods("GET")
 	router.HandleFunc("/coupons/validate", couponHandler.ValidateCoupon).Methods("POST")
 	router.HandleFunc("/coupons", couponHandler.GetAllCoupons).Methods("GET")
+	router.HandleFunc("/admin/categories", categoryHandler.CreateCategory).Methods("POST")
+	router.HandleFunc("/categories", categoryHandler.GetCategories).Methods("GET")
+	router.HandleFunc("/categories/{id}", categoryHandler.GetCategory).Methods("GET")
 	router.HandleFunc("/items", itemHandler.AddItem).Methods("POST")
 	router.HandleFunc("/items", itemHandler.GetItems).Methods("GET")
-	router.HandleFunc("/createorder", orderHandler.AddOrder).Methods("POST")
+	router.HandleFunc("/items/{id}", itemHandler.GetItem).Methods("GET")
+	router.HandleFunc("/items/{id}", itemHandler.UpdateItem).Methods("PUT")
+	router.HandleFunc("/items/{id}", itemHandler.PatchItem).Methods("PATCH")
+	router.HandleFunc("/items/{id}", itemHandler.DeleteItem).Methods("DELETE")
+	router.HandleFunc("/items/{id}/stock", itemHandler.SetStock).Methods("PUT")
+	router.HandleFunc("/createorder", handlers.Idempotent(idempotencyRepo, "createorder", orderHandler.AddOrder)).Methods("POST")
+	router.HandleFunc("/admin/orders", orderHandler.ListOrders).Methods("GET")
+	router.HandleFunc("/orders/{id}", orderHandler.GetOrder).Methods("GET")
+	router.HandleFunc("/orders/{id}/status", orderHandler.UpdateOrderStatus).Methods("PATCH")
+	router.HandleFunc("/orders/{id}/history", orderHandler.GetOrderStatusHistory).Methods("GET")
+	router.HandleFunc("/orders/{id}/returns", orderHandler.ReturnItems).Methods("POST")
 	router.HandleFunc("/users", userHandler.UserLogin).Methods("POST")
+	router.HandleFunc("/users/{id}/coupons", couponHandler.GetUserCoupons).Methods("GET")
+	router.HandleFunc("/users/{id}/orders", orderHandler.GetUserOrders).Methods("GET")
+	router.HandleFunc("/users/{id}/reservation", itemHandler.Reserve).Methods("PUT")
+	router.HandleFunc("/users/{id}/reservation", itemHandler.ReleaseReservation).Methods("DELETE")
 
 	return router
 }
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/gorilla/mux"
+)
+
+type reviewRequest struct {
+	Status string `json:"status"` // cleared / confirmed
+	Note   string `json:"note,omitempty"`
+}
+
+func (h *CouponHandler) ListFlaggedRedemptions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	res, err := h.Repo.ListFlaggedRedemptions(ctx, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"redemptions": res,
+	})
+}
+
+func (h *CouponHandler) ReviewRedemption(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	actor := r.Header.Get(AdminHeader)
+	if actor == "" {
+		http.Error(w, AdminHeader+" header is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid redemption id", http.StatusBadRequest)
+		return
+	}
+
+	var req reviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Status != repository.ReviewCleared && req.Status != repository.ReviewConfirmed {
+		http.Error(w, "invalid request body: status must be cleared or confirmed", http.StatusBadRequest)
+		return
+	}
+
+	err = h.Repo.ReviewRedemption(ctx, id, req.Status, actor, req.Note)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "flagged redemption not found", http.StatusNotFound)
+		return
+	case err == repository.ErrAlreadyReviewed:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  req.Status,
+		"message": "redemption reviewed",
+	})
+}
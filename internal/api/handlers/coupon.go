@@ -2,19 +2,36 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/throttle"
+	"github.com/Siddheshk02/coupon-system/internal/validation"
+	"github.com/gorilla/mux"
 )
 
+// AdminHeader identifies the admin performing a change.
+const AdminHeader = "X-Admin-ID"
+
 type CouponHandler struct {
 	Repo *repository.CouponRepository
+
+	// Attempts throttles users and IPs that keep entering invalid codes
+	Attempts          *throttle.Limiter
+	TrustForwardedFor bool
 }
 
-func NewCouponHandler(repo *repository.CouponRepository) *CouponHandler {
-	return &CouponHandler{Repo: repo}
+func NewCouponHandler(repo *repository.CouponRepository, attempts *throttle.Limiter, trustForwardedFor bool) *CouponHandler {
+	return &CouponHandler{Repo: repo, Attempts: attempts, TrustForwardedFor: trustForwardedFor}
 }
 
 func (h *CouponHandler) CreateCoupon(w http.ResponseWriter, r *http.Request) {
@@ -27,14 +44,176 @@ func (h *CouponHandler) CreateCoupon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.createCoupon(ctx, w, req)
+}
+
+// createCoupon validates and stores a new coupon, writing the response. It is
+// shared by every endpoint that creates coupons.
+func (h *CouponHandler) createCoupon(ctx context.Context, w http.ResponseWriter, req repository.Coupon) {
+	req.CouponCode = strings.TrimSpace(req.CouponCode)
+	if errs := validation.Coupon(req, time.Now()); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
 	err := h.Repo.CreateCoupon(ctx, req)
-	if err != nil {
+	var unknown *repository.UnknownReferenceError
+	if errors.As(err, &unknown) {
+		writeUnknownReference(w, unknown)
+		return
+	} else if err == repository.ErrDuplicateCode {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "coupon created"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":           "coupon created",
+		"coupon_code":       req.CouponCode,
+		"status":            repository.StatusDraft,
+		"requires_approval": h.Repo.Approval.RequiresApproval(req),
+	})
+}
+
+func (h *CouponHandler) UpdateCoupon(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var req repository.Coupon
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.CouponCode = mux.Vars(r)["code"]
+
+	actor := r.Header.Get(AdminHeader)
+	if actor == "" {
+		http.Error(w, AdminHeader+" header is required", http.StatusBadRequest)
+		return
+	}
+
+	if errs := validation.Coupon(req, time.Now()); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	err := h.Repo.UpdateCoupon(ctx, req, actor)
+	var unknown *repository.UnknownReferenceError
+	if errors.As(err, &unknown) {
+		writeUnknownReference(w, unknown)
+		return
+	} else if err == sql.ErrNoRows {
+		http.Error(w, "coupon not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "coupon updated"})
+}
+
+func (h *CouponHandler) GetCouponHistory(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	res, err := h.Repo.GetCouponHistory(ctx, mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(res) == 0 {
+		http.Error(w, "coupon not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"versions": res,
+	})
+}
+
+func (h *CouponHandler) ListCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	res, err := h.Repo.ListCoupons(ctx, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"coupons": res,
+	})
+}
+
+type transitionRequest struct {
+	Status string `json:"status"`
+	Note   string `json:"note,omitempty"`
+}
+
+func (h *CouponHandler) TransitionCoupon(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	actor := r.Header.Get(AdminHeader)
+	if actor == "" {
+		http.Error(w, AdminHeader+" header is required", http.StatusBadRequest)
+		return
+	}
+
+	var req transitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.Repo.TransitionCoupon(ctx, mux.Vars(r)["code"], req.Status, actor, req.Note)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "coupon not found", http.StatusNotFound)
+		return
+	case err == repository.ErrInvalidTransition, err == repository.ErrApprovalRequired:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err == repository.ErrSelfApproval:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  req.Status,
+		"message": "coupon status updated",
+	})
+}
+
+func (h *CouponHandler) GetCouponTransitions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	res, err := h.Repo.GetCouponTransitions(ctx, mux.Vars(r)["code"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "coupon not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transitions": res,
+	})
 }
 
 func (h *CouponHandler) GetAllCoupons(w http.ResponseWriter, r *http.Request) {
@@ -73,6 +252,12 @@ func (h *CouponHandler) GetApplicableCoupons(w http.ResponseWriter, r *http.Requ
 	case req.Timestamp == "":
 		http.Error(w, "invalid request body: timestamp required", http.StatusBadRequest)
 		return
+	case !validTimestamp(req.Timestamp):
+		http.Error(w, "invalid request body: "+repository.ErrInvalidTimestamp.Error(), http.StatusBadRequest)
+		return
+	case req.Channel != "" && !repository.IsValidChannel(req.Channel):
+		http.Error(w, "invalid request body: unknown channel", http.StatusBadRequest)
+		return
 	}
 
 	res, err := h.Repo.GetCoupons(ctx, req)
@@ -98,11 +283,15 @@ func (h *CouponHandler) ValidateCoupon(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := r.URL.Query()
-	userID := query.Get("user_id")
-	if userID == "" {
+	if query.Get("user_id") == "" {
 		http.Error(w, "user_id is required", http.StatusBadRequest)
 		return
 	}
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil {
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return
+	}
 
 	switch {
 	case req.CartItems == nil || len(req.CartItems) == 0:
@@ -114,32 +303,284 @@ func (h *CouponHandler) ValidateCoupon(w http.ResponseWriter, r *http.Request) {
 	case req.Timestamp == "":
 		http.Error(w, "invalid request body: timestamp required", http.StatusBadRequest)
 		return
-	case req.CouponCode == "":
-		http.Error(w, "invalid request body: coupon code required", http.StatusBadRequest)
+	case !validTimestamp(req.Timestamp):
+		http.Error(w, "invalid request body: "+repository.ErrInvalidTimestamp.Error(), http.StatusBadRequest)
+		return
+	case req.Channel != "" && !repository.IsValidChannel(req.Channel):
+		http.Error(w, "invalid request body: unknown channel", http.StatusBadRequest)
+		return
+	}
+
+	attempt, ok := beginCouponAttempt(ctx, w, r, h.Attempts, h.TrustForwardedFor, userID, req.CouponCode)
+	if !ok {
 		return
 	}
+	var reason string
+	defer func() { endCouponAttempt(ctx, attempt, reason) }()
 
-	items_discount, charges_discount, err := h.Repo.CheckCoupon(ctx, req, userID)
+	res, err := h.Repo.ValidateCart(ctx, req, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	reason = res.Reason
 
-	if items_discount == 0 && charges_discount == 0 {
+	if req.CouponCode != "" && res.Entered == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"is_valid":     false,
+			"reason":       res.Reason,
+			"auto_applied": res.AutoApplied,
+		})
+		return
+	}
+
+	if res.Entered == nil && len(res.AutoApplied) == 0 {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"is_valid": false,
-			"reason":   "coupon expired or not applicable",
+			"reason":   "no applicable promotions",
 		})
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	var items_discount, charges_discount float64
+	if res.Entered != nil {
+		items_discount += res.Entered.ItemsDiscount
+		charges_discount += res.Entered.ChargesDiscount
+	}
+	for _, c := range res.AutoApplied {
+		items_discount += c.ItemsDiscount
+		charges_discount += c.ChargesDiscount
+	}
+
+	resp := map[string]interface{}{
 		"is_valid": true,
 		"discount": map[string]float64{
 			"items_discount":   items_discount,
 			"charges_discount": charges_discount,
 		},
-		"message": "coupon applied successfully",
+		"auto_applied": res.AutoApplied,
+		"message":      "coupon applied successfully",
+	}
+	if res.Entered != nil {
+		resp["coupon_code"] = res.Entered.CouponCode // display form of the entered code
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *CouponHandler) AssignCoupon(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	code := mux.Vars(r)["code"]
+
+	var req repository.AssignCouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(req.UserIDs) == 0:
+		http.Error(w, "invalid request body: user_ids required", http.StatusBadRequest)
+		return
+	case req.MaxUses <= 0:
+		http.Error(w, "invalid request body: max_uses must be positive", http.StatusBadRequest)
+		return
+	}
+
+	err := h.Repo.AssignCoupon(ctx, code, req)
+	if err == sql.ErrNoRows {
+		http.Error(w, "coupon not found", http.StatusNotFound)
+		return
+	} else if err == repository.ErrUnknownUser {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "coupon assigned"})
+}
+
+func (h *CouponHandler) GetUserCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.Repo.GetUserCoupons(ctx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"coupons": res,
+	})
+}
+
+func (h *CouponHandler) SimulateCoupon(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var req repository.SimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Carts) == 0 {
+		http.Error(w, "invalid request body: no carts to simulate", http.StatusBadRequest)
+		return
+	}
+	for i, cart := range req.Carts {
+		if cart.Timestamp != "" && !validTimestamp(cart.Timestamp) {
+			http.Error(w, "invalid request body: carts["+strconv.Itoa(i)+"]: "+repository.ErrInvalidTimestamp.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if errs := validation.Coupon(req.Coupon, time.Now()); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	if !h.resolveApplicability(ctx, w, &req.Coupon) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": repository.SimulateCoupon(req),
+	})
+}
+
+func (h *CouponHandler) StartBacktest(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var req repository.BacktestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case req.From.IsZero() || req.To.IsZero():
+		http.Error(w, "invalid request body: from and to are required", http.StatusBadRequest)
+		return
+	case !req.To.After(req.From):
+		http.Error(w, "invalid request body: to must be after from", http.StatusBadRequest)
+		return
+	}
+
+	// The coupon only needs to have been live for the replayed orders
+	if errs := validation.Coupon(req.Coupon, req.From); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	if !h.resolveApplicability(ctx, w, &req.Coupon) {
+		return
+	}
+
+	id, err := h.Repo.StartBacktest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"job_id":  id,
+		"message": "backtest started",
 	})
 }
+
+func (h *CouponHandler) GetBacktest(w http.ResponseWriter, r *http.Request) {
+	job, found := h.Repo.GetBacktest(mux.Vars(r)["id"])
+	if !found {
+		http.Error(w, "backtest job not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+// resolveApplicability resolves the categories and items of a coupon that is
+// not stored, writing the response and returning false if one is unknown.
+func (h *CouponHandler) resolveApplicability(ctx context.Context, w http.ResponseWriter, coupon *repository.Coupon) bool {
+	err := h.Repo.ResolveApplicability(ctx, coupon)
+	var unknown *repository.UnknownReferenceError
+	if errors.As(err, &unknown) {
+		writeUnknownReference(w, unknown)
+		return false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func validTimestamp(s string) bool {
+	_, err := repository.ParseTimestamp(s)
+	return err == nil
+}
+
+// clientIP returns the address the request came from. X-Forwarded-For is
+// only trusted when the server runs behind a proxy that sets it, since
+// clients can send any value.
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// beginCouponAttempt counts an entered coupon code against the user and the
+// client IP before it is looked up, so that concurrent guesses are all
+// counted. It writes the response and returns false if the caller must wait.
+// The attempt is nil when no code was entered.
+func beginCouponAttempt(ctx context.Context, w http.ResponseWriter, r *http.Request, limiter *throttle.Limiter, trustForwardedFor bool, userID int, code string) (*throttle.Attempt, bool) {
+	if code == "" {
+		return nil, true
+	}
+
+	attempt, wait, err := limiter.Begin(ctx, "coupon:user:"+strconv.Itoa(userID), "coupon:ip:"+clientIP(r, trustForwardedFor))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many invalid coupon codes, try again later", http.StatusTooManyRequests)
+		return nil, false
+	}
+	return attempt, true
+}
+
+// endCouponAttempt leaves the attempt counted only if the code does not exist
+// for the user, the only outcome that counts as a guess.
+func endCouponAttempt(ctx context.Context, attempt *throttle.Attempt, reason string) {
+	if reason == repository.ReasonNotFound || reason == repository.ReasonNotIssuedToUser {
+		return
+	}
+	if err := attempt.Succeed(ctx); err != nil {
+		log.Printf("taking back coupon attempt: %v", err)
+	}
+}
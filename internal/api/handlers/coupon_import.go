@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/validation"
+)
+
+// maxImportSize bounds the size of an uploaded import file.
+const maxImportSize = 10 << 20
+
+// csvListSeparator joins list values inside a single CSV cell.
+const csvListSeparator = "|"
+
+// couponCSVColumns is the CSV layout used by both import and export. The
+// status column is only written on export and ignored on import.
+var couponCSVColumns = []string{
+	"coupon_code", "expiry_date", "usage_type", "applicable_categories", "applicable_category_ids",
+	"applicable_medicine_ids", "min_order_value",
+	"discount_type", "discount_value", "max_usage_per_user", "auto_apply", "stackable",
+	"allowed_payment_methods", "allowed_channels", "min_app_version",
+	"region_pincodes", "region_cities", "region_states", "region_exclude",
+	"eligibility_rule", "max_discount", "budget", "consume_on_cancel", "status",
+}
+
+func (h *CouponHandler) ImportCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	format := importFormat(r)
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	var rows []repository.ImportRow
+	var err error
+	if format == "csv" {
+		rows, err = parseCouponCSV(body)
+	} else {
+		rows, err = parseCouponJSONLines(body)
+	}
+	if err != nil {
+		http.Error(w, "invalid import file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) == 0 {
+		http.Error(w, "invalid import file: no rows", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	for i := range rows {
+		if rows[i].Err != nil {
+			continue
+		}
+		if errs := validation.Coupon(rows[i].Coupon, now); errs != nil {
+			rows[i].Err = errs
+		}
+	}
+
+	results, err := h.Repo.ImportCoupons(ctx, rows, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var failed int
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run":   dryRun,
+		"total":     len(results),
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+func (h *CouponHandler) ExportCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	var write func(repository.Coupon) error
+	if importFormat(r) == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="coupons.csv"`)
+		cw := csv.NewWriter(w)
+		if err := cw.Write(couponCSVColumns); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		write = func(c repository.Coupon) error {
+			if err := cw.Write(couponToCSV(c)); err != nil {
+				return err
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="coupons.jsonl"`)
+		enc := json.NewEncoder(w)
+		write = func(c repository.Coupon) error {
+			return enc.Encode(c)
+		}
+	}
+
+	// Headers are already sent, so a failure part way can only truncate the file
+	if err := h.Repo.ExportCoupons(ctx, write); err != nil {
+		log.Printf("coupon export failed: %v", err)
+	}
+}
+
+// importFormat picks csv or jsonl from the format query parameter, falling
+// back to the request's content type.
+func importFormat(r *http.Request) string {
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		return "csv"
+	case "jsonl", "json":
+		return "jsonl"
+	}
+	if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+func parseCouponJSONLines(body io.Reader) ([]repository.ImportRow, error) {
+	var rows []repository.ImportRow
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		row := repository.ImportRow{Row: line}
+		if err := json.Unmarshal([]byte(text), &row.Coupon); err != nil {
+			row.Err = fmt.Errorf("invalid JSON: %v", err)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, scanner.Err()
+}
+
+func parseCouponCSV(body io.Reader) ([]repository.ImportRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if !containsColumn(name) {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["coupon_code"]; !ok {
+		return nil, errors.New("missing coupon_code column")
+	}
+
+	var rows []repository.ImportRow
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+
+		row := repository.ImportRow{Row: line}
+		if err != nil {
+			row.Err = err
+		} else {
+			row.Coupon, row.Err = couponFromCSV(record, columns)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func containsColumn(name string) bool {
+	for _, c := range couponCSVColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func couponFromCSV(record []string, columns map[string]int) (repository.Coupon, error) {
+	var c repository.Coupon
+	var errs []string
+
+	get := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	list := func(name string) []string {
+		v := get(name)
+		if v == "" {
+			return nil
+		}
+		parts := strings.Split(v, csvListSeparator)
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		return parts
+	}
+	number := func(name string) float64 {
+		v := get(name)
+		if v == "" {
+			return 0
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			errs = append(errs, name+" must be a number")
+		}
+		return f
+	}
+	boolean := func(name string) bool {
+		v := get(name)
+		if v == "" {
+			return false
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, name+" must be true or false")
+		}
+		return b
+	}
+
+	c.CouponCode = get("coupon_code")
+	if v := get("expiry_date"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errs = append(errs, "expiry_date must be an RFC 3339 timestamp")
+		}
+		c.ExpiryDate = t
+	}
+	c.UsageType = repository.UsageType(get("usage_type"))
+	c.ApplicableCategories = list("applicable_categories")
+	for _, v := range list("applicable_category_ids") {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, "applicable_category_ids must be whole numbers")
+			break
+		}
+		c.ApplicableCategoryIDs = append(c.ApplicableCategoryIDs, id)
+	}
+	c.ApplicableMedicines = list("applicable_medicine_ids")
+	c.MinOrderValue = number("min_order_value")
+	c.DiscountType = repository.DiscountType(get("discount_type"))
+	c.DiscountValue = number("discount_value")
+	c.MaxUsagePerUser = int(number("max_usage_per_user"))
+	c.AutoApply = boolean("auto_apply")
+	c.Stackable = boolean("stackable")
+	c.PaymentMethods = list("allowed_payment_methods")
+	c.Channels = list("allowed_channels")
+	c.MinAppVersion = get("min_app_version")
+	c.Region.Pincodes = list("region_pincodes")
+	c.Region.Cities = list("region_cities")
+	c.Region.States = list("region_states")
+	c.Region.Exclude = boolean("region_exclude")
+	c.EligibilityRule = get("eligibility_rule")
+	c.MaxDiscount = number("max_discount")
+	c.Budget = number("budget")
+	c.ConsumeOnCancel = boolean("consume_on_cancel")
+
+	if len(errs) > 0 {
+		return c, errors.New(strings.Join(errs, "; "))
+	}
+	return c, nil
+}
+
+func couponToCSV(c repository.Coupon) []string {
+	number := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	categoryIDs := make([]string, len(c.ApplicableCategoryIDs))
+	for i, id := range c.ApplicableCategoryIDs {
+		categoryIDs[i] = strconv.Itoa(id)
+	}
+	return []string{
+		c.CouponCode,
+		c.ExpiryDate.Format(time.RFC3339),
+		string(c.UsageType),
+		strings.Join(c.ApplicableCategories, csvListSeparator),
+		strings.Join(categoryIDs, csvListSeparator),
+		strings.Join(c.ApplicableMedicines, csvListSeparator),
+		number(c.MinOrderValue),
+		string(c.DiscountType),
+		number(c.DiscountValue),
+		strconv.Itoa(c.MaxUsagePerUser),
+		strconv.FormatBool(c.AutoApply),
+		strconv.FormatBool(c.Stackable),
+		strings.Join(c.PaymentMethods, csvListSeparator),
+		strings.Join(c.Channels, csvListSeparator),
+		c.MinAppVersion,
+		strings.Join(c.Region.Pincodes, csvListSeparator),
+		strings.Join(c.Region.Cities, csvListSeparator),
+		strings.Join(c.Region.States, csvListSeparator),
+		strconv.FormatBool(c.Region.Exclude),
+		c.EligibilityRule,
+		number(c.MaxDiscount),
+		number(c.Budget),
+		strconv.FormatBool(c.ConsumeOnCancel),
+		c.Status,
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Siddheshk02/coupon-system/internal/repository"
+)
+
+func TestCouponCSVRoundTrip(t *testing.T) {
+	want := repository.Coupon{
+		CouponCode:            "SAVE20",
+		ExpiryDate:            time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		UsageType:             repository.UsageMultiUse,
+		ApplicableCategories:  []string{"Health/Pain Relief", "Vitamins"},
+		ApplicableCategoryIDs: []int{4, 7},
+		ApplicableMedicines:   []string{"12", "31"},
+		MinOrderValue:         250,
+		DiscountType:          repository.DiscountPercentage,
+		DiscountValue:         20,
+		MaxUsagePerUser:       2,
+		Stackable:             true,
+		PaymentMethods:        []string{"upi", "card"},
+		EligibilityRule:       `cart.total > 100`,
+		MaxDiscount:           150.5,
+	}
+
+	columns := map[string]int{}
+	for i, name := range couponCSVColumns {
+		columns[name] = i
+	}
+	got, err := couponFromCSV(couponToCSV(want), columns)
+	if err != nil {
+		t.Fatalf("couponFromCSV: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestCouponFromCSVInvalidCategoryIDs(t *testing.T) {
+	columns := map[string]int{"coupon_code": 0, "applicable_category_ids": 1}
+	_, err := couponFromCSV([]string{"SAVE20", "4|pain"}, columns)
+	if err == nil || !strings.Contains(err.Error(), "applicable_category_ids") {
+		t.Errorf("error = %v, want applicable_category_ids error", err)
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/validation"
+	"github.com/gorilla/mux"
+)
+
+// newCouponRequest names and dates a coupon created from an existing coupon
+// or a template.
+type newCouponRequest struct {
+	CouponCode string    `json:"coupon_code"`
+	ExpiryDate time.Time `json:"expiry_date"`
+}
+
+type saveTemplateRequest struct {
+	Name       string             `json:"name"`
+	FromCoupon string             `json:"from_coupon,omitempty"` // copy the rules of an existing coupon
+	Definition *repository.Coupon `json:"definition,omitempty"`
+}
+
+func (h *CouponHandler) CloneCoupon(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var req newCouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	source, err := h.Repo.GetCoupon(ctx, mux.Vars(r)["code"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "coupon not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	source.CouponCode = req.CouponCode
+	source.ExpiryDate = req.ExpiryDate
+	source.Status = ""
+	h.createCoupon(ctx, w, source)
+}
+
+func (h *CouponHandler) SaveTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var req saveTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case req.Name == "":
+		http.Error(w, "invalid request body: name required", http.StatusBadRequest)
+		return
+	case (req.FromCoupon == "") == (req.Definition == nil):
+		http.Error(w, "invalid request body: exactly one of from_coupon or definition required", http.StatusBadRequest)
+		return
+	}
+
+	var definition repository.Coupon
+	if req.Definition != nil {
+		definition = *req.Definition
+	} else {
+		var err error
+		definition, err = h.Repo.GetCoupon(ctx, req.FromCoupon)
+		if err == sql.ErrNoRows {
+			http.Error(w, "coupon not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if errs := validation.Template(definition); errs != nil {
+		if req.Definition != nil {
+			for i := range errs {
+				errs[i].Pointer = "/definition" + errs[i].Pointer
+			}
+		}
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	err := h.Repo.SaveTemplate(ctx, req.Name, definition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "template saved"})
+}
+
+func (h *CouponHandler) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	res, err := h.Repo.ListTemplates(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"templates": res,
+	})
+}
+
+func (h *CouponHandler) CreateFromTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var req newCouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	template, err := h.Repo.GetTemplate(ctx, mux.Vars(r)["name"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	coupon := template.Definition
+	coupon.CouponCode = req.CouponCode
+	coupon.ExpiryDate = req.ExpiryDate
+	h.createCoupon(ctx, w, coupon)
+}
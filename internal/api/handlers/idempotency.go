@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Siddheshk02/coupon-system/internal/repository"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Idempotent makes next safe to retry when the client sends an
+// Idempotency-Key header. The first response for a key is stored with a hash
+// of the request body and replayed for retries with the same body; reusing
+// the key with a different body is rejected with 409. Server errors and 429s
+// are not stored, so the request can be retried once the problem clears.
+// Requests without the header are passed through unchanged.
+func Idempotent(repo *repository.IdempotencyRepository, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > repository.MaxIdempotencyKeyLength {
+			http.Error(w, IdempotencyKeyHeader+" must be at most "+strconv.Itoa(repository.MaxIdempotencyKeyLength)+" characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		stored, err := repo.Begin(ctx, scope, key, hex.EncodeToString(sum[:]))
+		cancel()
+		switch {
+		case err == repository.ErrIdempotencyKeyReused, err == repository.ErrRequestInProgress:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		case stored != nil:
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// The key is settled even if the client has gone away, otherwise its
+		// retry would be turned away until the key's lock times out
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(r.Context()), 2*time.Second)
+		defer cancel()
+		if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+			err = repo.Release(ctx, scope, key)
+		} else {
+			err = repo.Complete(ctx, scope, key, repository.StoredResponse{
+				StatusCode:  rec.status,
+				ContentType: rec.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			})
+		}
+		if err != nil {
+			log.Printf("settling idempotency key %q: %v", key, err)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/gorilla/mux"
 )
 
 type ItemHandler struct {
@@ -28,8 +31,20 @@ func (h *ItemHandler) AddItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if msg := checkItemFields(&req.Category, &req.CategoryID, &req.Price); msg != "" {
+		http.Error(w, "invalid request body: "+msg, http.StatusBadRequest)
+		return
+	}
+	if req.Stock != nil && *req.Stock < 0 {
+		http.Error(w, "invalid request body: stock cannot be negative", http.StatusBadRequest)
+		return
+	}
+
 	err := h.Repo.CreateItem(ctx, req)
-	if err != nil {
+	if err == repository.ErrUnknownCategory {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -42,26 +57,308 @@ func (h *ItemHandler) GetItems(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
 
+	filter, err := itemFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, next, err := h.Repo.GetItems(ctx, filter)
+	switch {
+	case err == repository.ErrInvalidSort, err == repository.ErrInvalidCursor:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case filter.ID != 0 && len(items) == 0:
+		http.Error(w, "item not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"items":       items,
+		"next_cursor": next,
+	})
+}
+
+func itemFilter(r *http.Request) (repository.ItemFilter, error) {
 	query := r.URL.Query()
-	idStr := query.Get("id")
-	var id int
-	if idStr != "" {
-		var err error
-		id, err = strconv.Atoi(idStr)
-		if err != nil {
-			http.Error(w, "invalid id parameter", http.StatusBadRequest)
+	f := repository.ItemFilter{
+		Category: query.Get("category"),
+		Search:   query.Get("q"),
+		Sort:     query.Get("sort"),
+		Cursor:   query.Get("cursor"),
+	}
+
+	for name, dst := range map[string]*int{"id": &f.ID, "category_id": &f.CategoryID} {
+		if v := query.Get(name); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return f, errors.New("invalid " + name + " parameter")
+			}
+			*dst = id
+		}
+	}
+
+	for name, dst := range map[string]**float64{"min_price": &f.MinPrice, "max_price": &f.MaxPrice} {
+		if v := query.Get(name); v != "" {
+			price, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return f, errors.New("invalid " + name + " parameter")
+			}
+			*dst = &price
+		}
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return f, errors.New("invalid limit parameter")
+		}
+		f.Limit = limit
+	}
+
+	return f, nil
+}
+
+func (h *ItemHandler) GetItem(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	item, err := h.Repo.GetItem(ctx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "item not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"item": item,
+	})
+}
+
+func (h *ItemHandler) UpdateItem(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	var req repository.Item
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := checkItemFields(&req.Category, &req.CategoryID, &req.Price); msg != "" {
+		http.Error(w, "invalid request body: "+msg, http.StatusBadRequest)
+		return
+	}
+
+	item, err := h.Repo.UpdateItem(ctx, id, req)
+	writeItem(w, item, err)
+}
+
+func (h *ItemHandler) PatchItem(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	var req repository.ItemPatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := checkItemFields(req.Category, req.CategoryID, req.Price); msg != "" {
+		http.Error(w, "invalid request body: "+msg, http.StatusBadRequest)
+		return
+	}
+
+	item, err := h.Repo.PatchItem(ctx, id, req)
+	writeItem(w, item, err)
+}
+
+// checkItemFields checks the fields an update sets; nil fields are not set.
+func checkItemFields(category *string, categoryID *int, price *float64) string {
+	switch {
+	case category != nil && *category == "" && (categoryID == nil || *categoryID == 0):
+		return "category is required"
+	case price != nil && *price < 0:
+		return "price cannot be negative"
+	}
+	return ""
+}
+
+func writeItem(w http.ResponseWriter, item repository.Item, err error) {
+	switch {
+	case err == repository.ErrUnknownCategory:
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	case err == sql.ErrNoRows:
+		http.Error(w, "item not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Item updated successfully",
+		"item":    item,
+	})
+}
+
+func (h *ItemHandler) DeleteItem(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.Repo.DeleteItem(ctx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "item not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type stockRequest struct {
+	Stock *int `json:"stock"` // null stops tracking the item's stock
+}
+
+func (h *ItemHandler) SetStock(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	var req stockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Stock != nil && *req.Stock < 0 {
+		http.Error(w, "invalid request body: stock cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	err = h.Repo.SetStock(ctx, id, req.Stock)
+	if err == sql.ErrNoRows {
+		http.Error(w, "item not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Stock updated successfully"})
+}
+
+type reservationRequest struct {
+	Items []repository.OrderLine `json:"items"`
+}
+
+func (h *ItemHandler) Reserve(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var req reservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) == 0 {
+		http.Error(w, "invalid request body: no items added", http.StatusBadRequest)
+		return
+	}
+	for _, line := range req.Items {
+		if line.Quantity <= 0 {
+			http.Error(w, "invalid request body: quantity must be positive", http.StatusBadRequest)
 			return
 		}
 	}
-	category := query.Get("category")
 
-	items, err := h.Repo.GetItems(ctx, id, category)
+	reservation, err := h.Repo.Reserve(ctx, userID, req.Items)
+	var outOfStock *repository.OutOfStockError
+	switch {
+	case errors.As(err, &outOfStock):
+		writeOutOfStock(w, outOfStock)
+		return
+	case err == repository.ErrUnknownUser:
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	case err == repository.ErrUnknownItem:
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reservation": reservation,
+	})
+}
+
+func (h *ItemHandler) ReleaseReservation(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Repo.ReleaseReservation(ctx, userID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeOutOfStock(w http.ResponseWriter, err *repository.OutOfStockError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"items": items,
+		"error":     "item out of stock",
+		"item_id":   err.ItemID,
+		"available": err.Available,
 	})
 }
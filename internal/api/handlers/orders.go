@@ -2,37 +2,336 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/throttle"
+	"github.com/gorilla/mux"
 )
 
 type OrderHandler struct {
 	Repo *repository.OrderRepository
+
+	// Attempts is shared with coupon validation so codes cannot be guessed
+	// by placing orders instead
+	Attempts          *throttle.Limiter
+	TrustForwardedFor bool
 }
 
-func NewOrdersHandler(repo *repository.OrderRepository) *OrderHandler {
-	return &OrderHandler{Repo: repo}
+func NewOrdersHandler(repo *repository.OrderRepository, attempts *throttle.Limiter, trustForwardedFor bool) *OrderHandler {
+	return &OrderHandler{Repo: repo, Attempts: attempts, TrustForwardedFor: trustForwardedFor}
 }
 
 func (h *OrderHandler) AddOrder(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var req repository.PlaceOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(req.Items) == 0:
+		http.Error(w, "invalid request body: no items added", http.StatusBadRequest)
+		return
+	case req.Channel != "" && !repository.IsValidChannel(req.Channel):
+		http.Error(w, "invalid request body: unknown channel", http.StatusBadRequest)
+		return
+	}
+	for _, line := range req.Items {
+		if line.Quantity <= 0 {
+			http.Error(w, "invalid request body: quantity must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+
+	attempt, ok := beginCouponAttempt(ctx, w, r, h.Attempts, h.TrustForwardedFor, req.UserID, req.CouponCode)
+	if !ok {
+		return
+	}
+	var reason string
+	defer func() { endCouponAttempt(ctx, attempt, reason) }()
+
+	req.IdempotencyKey = r.Header.Get(IdempotencyKeyHeader)
+	order, err := h.Repo.PlaceOrder(ctx, req)
+	var rejected *repository.CouponRejectedError
+	var outOfStock *repository.OutOfStockError
+	switch {
+	case errors.As(err, &outOfStock):
+		writeOutOfStock(w, outOfStock)
+		return
+	case errors.As(err, &rejected):
+		reason = rejected.Reason
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":  "coupon cannot be applied",
+			"reason": rejected.Reason,
+		})
+		return
+	case err == repository.ErrOrderAlreadyPlaced:
+		w.Header().Set("Idempotent-Replayed", "true")
+	case err == repository.ErrUnknownUser, err == repository.ErrUnknownItem:
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Order placed successfully",
+		"order":   order,
+	})
+}
+
+type orderStatusRequest struct {
+	Status string `json:"status"`
+	Note   string `json:"note,omitempty"`
+}
+
+func (h *OrderHandler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
 
-	var req repository.Order
+	actor := r.Header.Get(AdminHeader)
+	if actor == "" {
+		http.Error(w, AdminHeader+" header is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid order id", http.StatusBadRequest)
+		return
+	}
+
+	var req orderStatusRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
+	if !repository.IsValidOrderStatus(req.Status) {
+		http.Error(w, "invalid request body: unknown status", http.StatusBadRequest)
+		return
+	}
 
-	err := h.Repo.CreateOrder(ctx, req)
+	err = h.Repo.TransitionOrder(ctx, id, req.Status, actor, req.Note)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	case err == repository.ErrInvalidTransition:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  req.Status,
+		"message": "order status updated",
+	})
+}
+
+func (h *OrderHandler) GetOrderStatusHistory(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid order id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.Repo.GetOrderStatusHistory(ctx, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if len(res) == 0 {
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Order placed successfully"})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"history": res,
+	})
+}
+
+type returnRequest struct {
+	Items []repository.OrderLine `json:"items"`
+	Note  string                 `json:"note,omitempty"`
+}
+
+func (h *OrderHandler) ReturnItems(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	actor := r.Header.Get(AdminHeader)
+	if actor == "" {
+		http.Error(w, AdminHeader+" header is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid order id", http.StatusBadRequest)
+		return
+	}
+
+	var req returnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) == 0 {
+		http.Error(w, "invalid request body: no items to return", http.StatusBadRequest)
+		return
+	}
+	for _, line := range req.Items {
+		if line.Quantity <= 0 {
+			http.Error(w, "invalid request body: quantity must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := h.Repo.ReturnItems(ctx, id, req.Items, actor, req.Note)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	case err == repository.ErrNotReturnable:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err == repository.ErrUnknownItem, err == repository.ErrInvalidReturn:
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *OrderHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid order id", http.StatusBadRequest)
+		return
+	}
+
+	order, err := h.Repo.GetOrder(ctx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
+func (h *OrderHandler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	h.listOrders(w, r, userID)
+}
+
+func (h *OrderHandler) ListOrders(w http.ResponseWriter, r *http.Request) {
+	h.listOrders(w, r, 0)
+}
+
+// listOrders writes a page of orders filtered by the query parameters,
+// limited to one user unless userID is 0.
+func (h *OrderHandler) listOrders(w http.ResponseWriter, r *http.Request, userID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter, err := orderFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserID = userID
+
+	orders, next, err := h.Repo.ListOrders(ctx, filter)
+	if err == repository.ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orders":      orders,
+		"next_cursor": next,
+	})
+}
+
+func orderFilter(r *http.Request) (repository.OrderFilter, error) {
+	query := r.URL.Query()
+	f := repository.OrderFilter{
+		Status:     query.Get("status"),
+		CouponCode: query.Get("coupon_code"),
+		Cursor:     query.Get("cursor"),
+	}
+
+	if f.Status != "" && !repository.IsValidOrderStatus(f.Status) {
+		return f, errors.New("unknown status")
+	}
+
+	for name, dst := range map[string]**time.Time{"from": &f.From, "to": &f.To} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, errors.New("invalid " + name + " parameter: must be an RFC 3339 timestamp")
+			}
+			*dst = &t
+		}
+	}
+
+	for name, dst := range map[string]**float64{"min_amount": &f.MinAmount, "max_amount": &f.MaxAmount} {
+		if v := query.Get(name); v != "" {
+			amount, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return f, errors.New("invalid " + name + " parameter")
+			}
+			*dst = &amount
+		}
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return f, errors.New("invalid limit parameter")
+		}
+		f.Limit = limit
+	}
+
+	return f, nil
 }
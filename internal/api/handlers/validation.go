@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/validation"
+)
+
+func writeValidationErrors(w http.ResponseWriter, errs validation.Errors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": errs,
+	})
+}
+
+// writeUnknownReference reports a category or item that does not exist like
+// any other invalid field.
+func writeUnknownReference(w http.ResponseWriter, err *repository.UnknownReferenceError) {
+	writeValidationErrors(w, validation.Errors{{Pointer: err.Pointer, Message: err.Message}})
+}
@@ -2,11 +2,40 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
 	Port  string
 	DBUrl string
+
+	// Coupons above these thresholds need a second admin's approval
+	ApprovalMaxPercentage float64
+	ApprovalRequireCap    bool
+	ApprovalRequireBudget bool
+
+	// Failed coupon code attempts, per user and per IP
+	ThrottleStore           string // memory or postgres
+	ThrottleFreeAttempts    int
+	ThrottleBaseDelay       time.Duration
+	ThrottleMaxDelay        time.Duration
+	ThrottleLockoutAfter    int
+	ThrottleLockoutDuration time.Duration
+	ThrottleWindow          time.Duration
+	TrustForwardedFor       bool // take the client IP from X-Forwarded-For, when behind a proxy
+
+	// Redemptions sharing device, phone or address signals across accounts
+	AbuseFlagLinkedAccounts  int
+	AbuseBlockLinkedAccounts int
+	AbuseFlagVelocity        int
+	AbuseWindow              time.Duration
+
+	// How long responses to requests with an Idempotency-Key are replayed
+	IdempotencyRetention time.Duration
+
+	ReservationTTL   time.Duration // how long a checkout holds stock
+	RejectOutOfStock bool          // reject coupon validation for carts with out-of-stock items
 }
 
 var AppConfig Config
@@ -20,5 +49,63 @@ func Load() {
 	AppConfig = Config{
 		Port:  os.Getenv("PORT"),
 		DBUrl: os.Getenv("DB_URL"),
+
+		ApprovalMaxPercentage: getEnvFloat("APPROVAL_MAX_PERCENTAGE", 30),
+		ApprovalRequireCap:    getEnvBool("APPROVAL_REQUIRE_CAP", true),
+		ApprovalRequireBudget: getEnvBool("APPROVAL_REQUIRE_BUDGET", true),
+
+		ThrottleStore:           getEnv("THROTTLE_STORE", "memory"),
+		ThrottleFreeAttempts:    getEnvInt("THROTTLE_FREE_ATTEMPTS", 3),
+		ThrottleBaseDelay:       getEnvDuration("THROTTLE_BASE_DELAY", time.Second),
+		ThrottleMaxDelay:        getEnvDuration("THROTTLE_MAX_DELAY", 5*time.Minute),
+		ThrottleLockoutAfter:    getEnvInt("THROTTLE_LOCKOUT_AFTER", 10),
+		ThrottleLockoutDuration: getEnvDuration("THROTTLE_LOCKOUT_DURATION", 30*time.Minute),
+		ThrottleWindow:          getEnvDuration("THROTTLE_WINDOW", time.Hour),
+		TrustForwardedFor:       getEnvBool("TRUST_FORWARDED_FOR", false),
+
+		AbuseFlagLinkedAccounts:  getEnvInt("ABUSE_FLAG_LINKED_ACCOUNTS", 1),
+		AbuseBlockLinkedAccounts: getEnvInt("ABUSE_BLOCK_LINKED_ACCOUNTS", 2),
+		AbuseFlagVelocity:        getEnvInt("ABUSE_FLAG_VELOCITY", 3),
+		AbuseWindow:              getEnvDuration("ABUSE_WINDOW", 30*24*time.Hour),
+
+		IdempotencyRetention: getEnvDuration("IDEMPOTENCY_RETENTION", 24*time.Hour),
+
+		ReservationTTL:   getEnvDuration("RESERVATION_TTL", 15*time.Minute),
+		RejectOutOfStock: getEnvBool("REJECT_OUT_OF_STOCK", false),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
 	}
+	return fallback
 }
@@ -0,0 +1,281 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Statuses of a flagged redemption in the review queue.
+const (
+	ReviewPending   = "pending"
+	ReviewCleared   = "cleared"   // not abuse; the user may redeem the coupon
+	ReviewConfirmed = "confirmed" // abuse; the redemption stays blocked
+)
+
+// Kinds of signal that link accounts to the same person.
+const (
+	SignalDevice  = "device"
+	SignalPhone   = "phone"
+	SignalAddress = "address"
+)
+
+var ErrAlreadyReviewed = errors.New("redemption has already been reviewed")
+
+// Signals identify the person behind an account. Values are normalized and
+// only stored hashed.
+type Signals struct {
+	DeviceID string `json:"device_id,omitempty"` // device fingerprint
+	Phone    string `json:"phone,omitempty"`
+	Address  string `json:"address,omitempty"`
+}
+
+// AbusePolicy decides when redemptions sharing signals with other accounts
+// are flagged for review or blocked. A zero threshold disables that check.
+type AbusePolicy struct {
+	FlagLinkedAccounts  int           // other accounts that redeemed the same coupon with a shared signal
+	BlockLinkedAccounts int           // as above, but the redemption is rejected
+	FlagVelocity        int           // other accounts that redeemed any coupon with a shared signal
+	Window              time.Duration // how far back redemptions are compared
+}
+
+type FlaggedRedemption struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	CouponCode     string     `json:"coupon_code"`
+	Blocked        bool       `json:"blocked"`
+	LinkedAccounts []int64    `json:"linked_accounts"`
+	Velocity       int        `json:"velocity"`
+	Status         string     `json:"status"`
+	ReviewedBy     string     `json:"reviewed_by,omitempty"`
+	ReviewNote     string     `json:"review_note,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ReviewedAt     *time.Time `json:"reviewed_at,omitempty"`
+}
+
+type signal struct {
+	kind string
+	hash string
+}
+
+// signalHashes returns the normalized, hashed signals that are present.
+func signalHashes(s Signals) []signal {
+	var out []signal
+	add := func(kind, value string) {
+		if value == "" {
+			return
+		}
+		sum := sha256.Sum256([]byte(kind + ":" + value))
+		out = append(out, signal{kind: kind, hash: hex.EncodeToString(sum[:])})
+	}
+
+	add(SignalDevice, strings.TrimSpace(s.DeviceID))
+	add(SignalPhone, strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s.Phone))
+	add(SignalAddress, strings.Join(strings.Fields(strings.ToLower(s.Address)), " "))
+	return out
+}
+
+// abuseCheck is how a redemption's signals compare with other accounts'
+// recent redemptions.
+type abuseCheck struct {
+	review   string // status of the user's entry in the review queue, if any
+	hashes   []signal
+	linked   pq.Int64Array // other accounts that redeemed the coupon with a shared signal
+	velocity int           // other accounts that redeemed any coupon with a shared signal
+	blocked  bool
+	flagged  bool
+}
+
+// rejected reports whether the redemption must be blocked. Once reviewed, an
+// admin's decision overrides the thresholds.
+func (c abuseCheck) rejected() bool {
+	return c.review == ReviewConfirmed || c.blocked && c.review != ReviewCleared
+}
+
+// assessAbuse compares the redemption's signals with other accounts' recent
+// redemptions. It only reads.
+func (r *CouponRepository) assessAbuse(ctx context.Context, q queryRower, couponCode string, userID int, signals Signals) (abuseCheck, error) {
+	var c abuseCheck
+	err := q.QueryRowContext(ctx, `SELECT status FROM flagged_redemptions WHERE user_id = $1 AND coupon_code = $2`, userID, couponCode).Scan(&c.review)
+	if err != nil && err != sql.ErrNoRows {
+		return c, err
+	}
+
+	c.hashes = signalHashes(signals)
+	if len(c.hashes) == 0 {
+		return c, nil
+	}
+
+	kinds := make([]string, len(c.hashes))
+	values := make([]string, len(c.hashes))
+	for i, s := range c.hashes {
+		kinds[i], values[i] = s.kind, s.hash
+	}
+
+	query := `SELECT COALESCE(ARRAY_AGG(DISTINCT user_id) FILTER (WHERE coupon_code = $2), '{}'),
+                     COUNT(DISTINCT user_id)
+              FROM redemption_signals
+              WHERE user_id <> $1 AND created_at > $3
+                AND (kind, value) IN (SELECT * FROM UNNEST($4::text[], $5::text[]))`
+
+	since := time.Now().Add(-r.Abuse.Window)
+	err = q.QueryRowContext(ctx, query, userID, couponCode, since, pq.Array(kinds), pq.Array(values)).Scan(&c.linked, &c.velocity)
+	if err != nil {
+		return c, err
+	}
+
+	p := r.Abuse
+	c.blocked = p.BlockLinkedAccounts > 0 && len(c.linked) >= p.BlockLinkedAccounts
+	c.flagged = c.blocked ||
+		p.FlagLinkedAccounts > 0 && len(c.linked) >= p.FlagLinkedAccounts ||
+		p.FlagVelocity > 0 && c.velocity >= p.FlagVelocity
+	return c, nil
+}
+
+// checkAbuse returns ReasonLinkedAccounts if the redemption must be blocked.
+// It only reads, so that validating a cart leaves no trace; signals and flags
+// are recorded once an order redeems the coupon.
+func (r *CouponRepository) checkAbuse(ctx context.Context, q queryRower, couponCode string, userID int, signals Signals) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+
+	c, err := r.assessAbuse(ctx, q, couponCode, userID, signals)
+	if err != nil {
+		return "", err
+	}
+	if c.rejected() {
+		return ReasonLinkedAccounts, nil
+	}
+	return "", nil
+}
+
+// recordRedemption records the signals of a redemption made by an order in
+// tx, and adds it to the review queue if it is suspicious.
+func (r *CouponRepository) recordRedemption(ctx context.Context, tx *sql.Tx, couponCode string, userID int, signals Signals) error {
+	c, err := r.assessAbuse(ctx, tx, couponCode, userID, signals)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO redemption_signals (user_id, coupon_code, kind, value, created_at)
+              VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (user_id, coupon_code, kind, value) DO UPDATE SET created_at = EXCLUDED.created_at`
+
+	now := time.Now()
+	for _, s := range c.hashes {
+		if _, err := tx.ExecContext(ctx, query, userID, couponCode, s.kind, s.hash, now); err != nil {
+			return err
+		}
+	}
+
+	if !c.flagged || c.review == ReviewCleared {
+		return nil
+	}
+	return queueFlaggedRedemption(ctx, tx, couponCode, userID, c)
+}
+
+// flagBlockedRedemption adds a redemption that was blocked to the review
+// queue, so that an admin can clear it. The blocked attempt's signals are
+// not recorded, so they cannot count against other accounts.
+func (r *CouponRepository) flagBlockedRedemption(ctx context.Context, code string, userID int, signals Signals) error {
+	couponCode, err := lookupCouponCode(ctx, r.DB, NormalizeCode(code))
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	c, err := r.assessAbuse(ctx, r.DB, couponCode, userID, signals)
+	if err != nil || !c.blocked || c.review == ReviewCleared {
+		return err
+	}
+	return queueFlaggedRedemption(ctx, r.DB, couponCode, userID, c)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// queueFlaggedRedemption keeps one queue entry per user and coupon, refreshed
+// while it is pending.
+func queueFlaggedRedemption(ctx context.Context, e execer, couponCode string, userID int, c abuseCheck) error {
+	query := `INSERT INTO flagged_redemptions (user_id, coupon_code, blocked, linked_accounts, velocity, status, created_at)
+              VALUES ($1, $2, $3, $4, $5, $6, $7)
+              ON CONFLICT (user_id, coupon_code) DO UPDATE SET
+                  blocked = EXCLUDED.blocked, linked_accounts = EXCLUDED.linked_accounts, velocity = EXCLUDED.velocity
+              WHERE flagged_redemptions.status = $6`
+	_, err := e.ExecContext(ctx, query, userID, couponCode, c.blocked, c.linked, c.velocity, ReviewPending, time.Now())
+	return err
+}
+
+// ListFlaggedRedemptions returns the review queue, newest first, optionally
+// filtered by status.
+func (r *CouponRepository) ListFlaggedRedemptions(ctx context.Context, status string) ([]FlaggedRedemption, error) {
+	query := `SELECT id, user_id, coupon_code, blocked, linked_accounts, velocity, status,
+                     COALESCE(reviewed_by, ''), COALESCE(review_note, ''), created_at, reviewed_at
+              FROM flagged_redemptions WHERE ($1 = '' OR status = $1) ORDER BY created_at DESC, id DESC`
+
+	rows, err := r.DB.QueryContext(ctx, query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flagged []FlaggedRedemption
+	for rows.Next() {
+		var f FlaggedRedemption
+		var linked pq.Int64Array
+		if err := rows.Scan(&f.ID, &f.UserID, &f.CouponCode, &f.Blocked, &linked, &f.Velocity, &f.Status,
+			&f.ReviewedBy, &f.ReviewNote, &f.CreatedAt, &f.ReviewedAt); err != nil {
+			return nil, err
+		}
+		f.LinkedAccounts = linked
+		flagged = append(flagged, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return flagged, nil
+}
+
+// ReviewRedemption records an admin's decision on a pending flagged
+// redemption. It returns sql.ErrNoRows if it does not exist and
+// ErrAlreadyReviewed if a decision was already made.
+func (r *CouponRepository) ReviewRedemption(ctx context.Context, id int, status, actor, note string) error {
+	query := `UPDATE flagged_redemptions SET status = $2, reviewed_by = $3, review_note = $4, reviewed_at = $5
+              WHERE id = $1 AND status = $6`
+
+	res, err := r.DB.ExecContext(ctx, query, id, status, actor, note, time.Now(), ReviewPending)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	if err := r.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM flagged_redemptions WHERE id = $1)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return ErrAlreadyReviewed
+}
@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Coupon statuses. Only live coupons can be redeemed.
+const (
+	StatusDraft           = "draft"
+	StatusPendingApproval = "pending_approval"
+	StatusApproved        = "approved"
+	StatusRejected        = "rejected"
+	StatusLive            = "live"
+)
+
+var (
+	ErrInvalidTransition = errors.New("invalid status transition")
+	ErrApprovalRequired  = errors.New("coupon requires approval before going live")
+	ErrSelfApproval      = errors.New("coupon must be approved by a different admin than the one who submitted it")
+)
+
+// couponTransitions lists the statuses each status can move to.
+var couponTransitions = map[string][]string{
+	StatusDraft:           {StatusPendingApproval, StatusLive},
+	StatusPendingApproval: {StatusApproved, StatusRejected},
+	StatusApproved:        {StatusLive},
+	StatusRejected:        {StatusDraft},
+	StatusLive:            {StatusDraft},
+}
+
+// ApprovalPolicy decides which coupons need a second admin's approval.
+type ApprovalPolicy struct {
+	MaxPercentage float64 // percentage discounts above this need approval
+	RequireCap    bool    // percentage discounts without a max_discount need approval
+	RequireBudget bool    // coupons without a budget need approval
+}
+
+func (p ApprovalPolicy) RequiresApproval(coupon Coupon) bool {
+	if coupon.DiscountType == DiscountPercentage {
+		if coupon.DiscountValue > p.MaxPercentage {
+			return true
+		}
+		if p.RequireCap && coupon.MaxDiscount <= 0 {
+			return true
+		}
+	}
+	return p.RequireBudget && coupon.Budget <= 0
+}
+
+type StatusTransition struct {
+	CouponCode string    `json:"coupon_code"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Actor      string    `json:"actor"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TransitionCoupon moves the coupon to a new status on behalf of actor. It
+// returns sql.ErrNoRows if the coupon does not exist.
+func (r *CouponRepository) TransitionCoupon(ctx context.Context, couponCode, to, actor, note string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	coupon, err := scanCoupon(tx.QueryRowContext(ctx, `SELECT `+couponSelectColumns+` FROM coupons WHERE normalized_code = $1 FOR UPDATE`, NormalizeCode(couponCode)))
+	if err != nil {
+		return err
+	}
+	couponCode = coupon.CouponCode
+
+	if !containsString(couponTransitions[coupon.Status], to) {
+		return ErrInvalidTransition
+	}
+
+	switch to {
+	case StatusLive:
+		if coupon.Status == StatusDraft && r.Approval.RequiresApproval(coupon) {
+			return ErrApprovalRequired
+		}
+	case StatusApproved, StatusRejected:
+		var submitter string
+		err := tx.QueryRowContext(ctx, `SELECT actor FROM coupon_status_transitions
+                                        WHERE coupon_code = $1 AND to_status = $2
+                                        ORDER BY created_at DESC, id DESC LIMIT 1`, couponCode, StatusPendingApproval).Scan(&submitter)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if submitter == actor {
+			return ErrSelfApproval
+		}
+	}
+
+	if err := setCouponStatus(ctx, tx, couponCode, coupon.Status, to, actor, note); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		r.Cache.Delete("all_coupons") // Invalidate the cache
+	}
+	return err
+}
+
+func setCouponStatus(ctx context.Context, tx *sql.Tx, couponCode, from, to, actor, note string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE coupons SET status = $2 WHERE coupon_code = $1`, couponCode, to); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO coupon_status_transitions (coupon_code, from_status, to_status, actor, note, created_at)
+              VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := tx.ExecContext(ctx, query, couponCode, from, to, actor, note, time.Now())
+	return err
+}
+
+// GetCouponTransitions returns the coupon's status transitions, oldest
+// first. It returns sql.ErrNoRows if the coupon does not exist.
+func (r *CouponRepository) GetCouponTransitions(ctx context.Context, couponCode string) ([]StatusTransition, error) {
+	code, err := lookupCouponCode(ctx, r.DB, NormalizeCode(couponCode))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.DB.QueryContext(ctx, `SELECT coupon_code, from_status, to_status, actor, COALESCE(note, ''), created_at
+                                         FROM coupon_status_transitions
+                                         WHERE coupon_code = $1 ORDER BY created_at, id`, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transitions []StatusTransition
+	for rows.Next() {
+		var t StatusTransition
+		if err := rows.Scan(&t.CouponCode, &t.FromStatus, &t.ToStatus, &t.Actor, &t.Note, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transitions, nil
+}
+
+// ListCoupons returns every coupon in the given status, or all coupons if
+// status is empty.
+func (r *CouponRepository) ListCoupons(ctx context.Context, status string) ([]Coupon, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+couponSelectColumns+` FROM coupons WHERE ($1 = '' OR status = $1) ORDER BY coupon_code`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []Coupon
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return coupons, nil
+}
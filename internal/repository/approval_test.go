@@ -0,0 +1,50 @@
+package repository
+
+import "testing"
+
+func TestCouponTransitions(t *testing.T) {
+	statuses := []string{StatusDraft, StatusPendingApproval, StatusApproved, StatusRejected, StatusLive}
+	allowed := map[[2]string]bool{
+		{StatusDraft, StatusPendingApproval}:    true,
+		{StatusDraft, StatusLive}:               true,
+		{StatusPendingApproval, StatusApproved}: true,
+		{StatusPendingApproval, StatusRejected}: true,
+		{StatusApproved, StatusLive}:            true,
+		{StatusRejected, StatusDraft}:           true,
+		{StatusLive, StatusDraft}:               true,
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[[2]string{from, to}]
+			if got := containsString(couponTransitions[from], to); got != want {
+				t.Errorf("%s -> %s allowed = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestRequiresApproval(t *testing.T) {
+	policy := ApprovalPolicy{MaxPercentage: 30, RequireCap: true, RequireBudget: true}
+
+	tests := []struct {
+		name   string
+		policy ApprovalPolicy
+		coupon Coupon
+		want   bool
+	}{
+		{"capped and budgeted", policy, Coupon{DiscountType: "percentage", DiscountValue: 20, MaxDiscount: 100, Budget: 1000}, false},
+		{"percentage above limit", policy, Coupon{DiscountType: "percentage", DiscountValue: 40, MaxDiscount: 100, Budget: 1000}, true},
+		{"percentage at limit", policy, Coupon{DiscountType: "percentage", DiscountValue: 30, MaxDiscount: 100, Budget: 1000}, false},
+		{"percentage without cap", policy, Coupon{DiscountType: "percentage", DiscountValue: 20, Budget: 1000}, true},
+		{"no budget", policy, Coupon{DiscountType: "fixed", DiscountValue: 50}, true},
+		{"fixed needs no cap", policy, Coupon{DiscountType: "fixed", DiscountValue: 500, Budget: 1000}, false},
+		{"checks disabled", ApprovalPolicy{MaxPercentage: 100}, Coupon{DiscountType: "percentage", DiscountValue: 20}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.RequiresApproval(tt.coupon); got != tt.want {
+			t.Errorf("%s: RequiresApproval = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Backtest jobs are kept in memory for this long after they are started.
+const backtestRetention = 24 * time.Hour
+
+// Segments orders are grouped by, based on the user's prior order count.
+const (
+	SegmentNew       = "new"       // first order
+	SegmentReturning = "returning" // 1-4 prior orders
+	SegmentLoyal     = "loyal"     // 5+ prior orders
+)
+
+type BacktestRequest struct {
+	Coupon    Coupon             `json:"coupon"`
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	LineItems map[int][]CartItem `json:"line_items,omitempty"` // keyed by order id
+}
+
+type SegmentReport struct {
+	Orders        int     `json:"orders"`
+	Qualified     int     `json:"qualified"`
+	TotalDiscount float64 `json:"total_discount"`
+}
+
+type BacktestReport struct {
+	OrdersEvaluated    int                       `json:"orders_evaluated"`
+	OrdersQualified    int                       `json:"orders_qualified"`
+	OrdersWithoutItems int                       `json:"orders_without_items"`
+	TotalDiscount      float64                   `json:"total_discount"`
+	Segments           map[string]*SegmentReport `json:"segments"`
+	Rejections         map[string]int            `json:"rejections"`
+}
+
+type BacktestJob struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"` // running / completed / failed
+	Error      string          `json:"error,omitempty"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Report     *BacktestReport `json:"report,omitempty"`
+}
+
+// StartBacktest replays the proposed coupon against historical orders in the
+// background and returns the job id to poll with GetBacktest.
+func (r *CouponRepository) StartBacktest(req BacktestRequest) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	job := BacktestJob{ID: id, Status: "running", StartedAt: time.Now()}
+	r.Cache.Set("backtest:"+id, job, backtestRetention)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		report, err := r.Backtest(ctx, req)
+		finished := time.Now()
+		job.FinishedAt = &finished
+		if err != nil {
+			job.Status = "failed"
+			job.Error = err.Error()
+		} else {
+			job.Status = "completed"
+			job.Report = &report
+		}
+		r.Cache.Set("backtest:"+id, job, backtestRetention)
+	}()
+
+	return id, nil
+}
+
+func (r *CouponRepository) GetBacktest(id string) (BacktestJob, bool) {
+	cached, found := r.Cache.Get("backtest:" + id)
+	if !found {
+		return BacktestJob{}, false
+	}
+	return cached.(BacktestJob), true
+}
+
+// Backtest replays the coupon against every order placed in the date range,
+// in order, as if the coupon had been live at the time. Users are segmented
+// by every order they placed before, including ones before the range, and
+// start the range with the uses they already made of a live coupon with the
+// same code. Line items given in the request take precedence over the ones
+// stored with the order. Orders without line items are assumed to contain an
+// item from the coupon's categories, and are counted separately so the
+// estimate can be judged.
+func (r *CouponRepository) Backtest(ctx context.Context, req BacktestRequest) (BacktestReport, error) {
+	// Prior orders are counted over the whole history before the range is
+	// applied, leaving out cancelled ones as validation does
+	query := `WITH history AS (
+                  SELECT id, user_id, ordered_at, subtotal,
+                         COUNT(*) FILTER (WHERE order_status <> 'cancelled')
+                             OVER (PARTITION BY user_id ORDER BY ordered_at, id ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING) AS prior_orders
+                  FROM orders WHERE ordered_at < $2)
+              SELECT h.id, h.user_id, h.ordered_at, h.subtotal, u.created_at, h.prior_orders,
+                     (SELECT COUNT(*) FROM orders p
+                      JOIN order_coupons oc ON oc.order_id = p.id JOIN coupons c ON c.coupon_code = oc.coupon_code
+                      WHERE p.user_id = h.user_id AND p.ordered_at < $1 AND oc.released_at IS NULL AND c.normalized_code = $3),
+                     (SELECT COALESCE(JSON_AGG(JSON_BUILD_OBJECT('id', oi.item_id::text, 'name', oi.name, 'category', oi.category,
+                                                                 'price', oi.unit_price * oi.quantity) ORDER BY oi.id), '[]')
+                      FROM order_items oi WHERE oi.order_id = h.id)
+              FROM history h
+              JOIN users u ON u.id = h.user_id
+              WHERE h.ordered_at >= $1
+              ORDER BY h.ordered_at, h.id`
+
+	report := BacktestReport{
+		Segments: map[string]*SegmentReport{
+			SegmentNew:       {},
+			SegmentReturning: {},
+			SegmentLoyal:     {},
+		},
+		Rejections: map[string]int{},
+	}
+
+	rows, err := r.DB.QueryContext(ctx, query, req.From, req.To, NormalizeCode(req.Coupon.CouponCode))
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	uses := map[int]int{}
+	for rows.Next() {
+		var orderID, userID, priorOrders, priorUses int
+		var orderedAt, createdAt time.Time
+		var subtotal float64
+		var storedItems []byte
+		if err := rows.Scan(&orderID, &userID, &orderedAt, &subtotal, &createdAt, &priorOrders, &priorUses, &storedItems); err != nil {
+			return report, err
+		}
+		if _, ok := uses[userID]; !ok {
+			uses[userID] = priorUses
+		}
+
+		items := req.LineItems[orderID]
+		if len(items) == 0 {
+			if err := json.Unmarshal(storedItems, &items); err != nil {
+				return report, err
+			}
+		}
+
+		cart := CouponRequest{
+			CartItems:  items,
+			OrderTotal: subtotal,
+			Timestamp:  orderedAt.Format(time.RFC3339),
+			CouponCode: req.Coupon.CouponCode,
+		}
+		if len(cart.CartItems) == 0 {
+			report.OrdersWithoutItems++
+			var category string
+			if len(req.Coupon.ApplicableCategories) > 0 {
+				category = req.Coupon.ApplicableCategories[0]
+			}
+			cart.CartItems = []CartItem{{Category: category, Price: subtotal}}
+		}
+
+		user := Redeemer{
+			UserID:         userID,
+			OrderCount:     priorOrders,
+			AccountAgeDays: int(orderedAt.Sub(createdAt).Hours() / 24),
+			CouponUses:     uses[userID],
+		}
+
+		segment := report.Segments[userSegment(priorOrders)]
+		segment.Orders++
+		report.OrdersEvaluated++
+
+		if reason := evaluateCoupon(req.Coupon, cart, &user); reason != "" {
+			report.Rejections[reason]++
+			continue
+		}
+
+		itemsDiscount, chargesDiscount := calculateDiscount(req.Coupon, cart)
+		discount := itemsDiscount + chargesDiscount
+
+		uses[userID]++
+		segment.Qualified++
+		segment.TotalDiscount += discount
+		report.OrdersQualified++
+		report.TotalDiscount += discount
+	}
+
+	return report, rows.Err()
+}
+
+func userSegment(priorOrders int) string {
+	switch {
+	case priorOrders == 0:
+		return SegmentNew
+	case priorOrders < 5:
+		return SegmentReturning
+	}
+	return SegmentLoyal
+}
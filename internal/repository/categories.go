@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CategorySeparator joins category names into a path from the top-level
+// category down, e.g. "Pain Relief > Topical".
+const CategorySeparator = " > "
+
+var (
+	ErrUnknownCategory   = errors.New("category does not exist")
+	ErrDuplicateCategory = errors.New("category already exists")
+	ErrInvalidCategory   = errors.New("category name must not be empty or contain '>'")
+)
+
+type Category struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	ParentID  *int      `json:"parent_id,omitempty"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CategoryRepository struct {
+	DB *sql.DB
+}
+
+func NewCategoryRepository(db *sql.DB) *CategoryRepository {
+	return &CategoryRepository{DB: db}
+}
+
+// NormalizeCategoryPath tidies the spacing of a category path so that
+// "pain relief>topical" and "pain relief > topical" are the same path.
+// Paths are matched ignoring case.
+func NormalizeCategoryPath(path string) string {
+	names := strings.Split(path, ">")
+	for i, name := range names {
+		names[i] = strings.Join(strings.Fields(name), " ")
+	}
+	return strings.Join(names, CategorySeparator)
+}
+
+// categoryCovers reports whether a coupon on category applies to an item in
+// itemCategory: the same category or one of its descendants.
+func categoryCovers(category, itemCategory string) bool {
+	c := strings.ToLower(NormalizeCategoryPath(category))
+	i := strings.ToLower(NormalizeCategoryPath(itemCategory))
+	return c != "" && (i == c || strings.HasPrefix(i, c+CategorySeparator))
+}
+
+// categorySubtree selects the ids of the categories matched by where and all
+// of their descendants.
+func categorySubtree(where string) string {
+	return `(WITH RECURSIVE subtree AS (
+                 SELECT id FROM categories WHERE ` + where + `
+                 UNION ALL
+                 SELECT c.id FROM categories c JOIN subtree ON c.parent_id = subtree.id)
+             SELECT id FROM subtree)`
+}
+
+// CreateCategory adds a category under its parent, or at the top level if it
+// has none. It returns ErrInvalidCategory, ErrUnknownCategory if the parent
+// does not exist, or ErrDuplicateCategory if the parent already has a
+// category with that name.
+func (c *CategoryRepository) CreateCategory(ctx context.Context, category Category) (Category, error) {
+	category.Name = strings.Join(strings.Fields(category.Name), " ")
+	if category.Name == "" || strings.Contains(category.Name, ">") {
+		return category, ErrInvalidCategory
+	}
+
+	category.Path = category.Name
+	if category.ParentID != nil {
+		var parentPath string
+		err := c.DB.QueryRowContext(ctx, `SELECT path FROM categories WHERE id = $1`, *category.ParentID).Scan(&parentPath)
+		if err == sql.ErrNoRows {
+			return category, ErrUnknownCategory
+		} else if err != nil {
+			return category, err
+		}
+		category.Path = parentPath + CategorySeparator + category.Name
+	}
+
+	category.CreatedAt = time.Now()
+	query := `INSERT INTO categories (name, parent_id, path, created_at) VALUES ($1, $2, $3, $4) RETURNING id`
+	err := c.DB.QueryRowContext(ctx, query, category.Name, category.ParentID, category.Path, category.CreatedAt).Scan(&category.ID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return category, ErrDuplicateCategory
+	}
+	return category, err
+}
+
+func scanCategory(row rowScanner) (Category, error) {
+	var category Category
+	var parentID sql.NullInt64
+	err := row.Scan(&category.ID, &category.Name, &parentID, &category.Path, &category.CreatedAt)
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		category.ParentID = &id
+	}
+	return category, err
+}
+
+// GetCategory returns the category, or sql.ErrNoRows.
+func (c *CategoryRepository) GetCategory(ctx context.Context, id int) (Category, error) {
+	return scanCategory(c.DB.QueryRowContext(ctx, `SELECT id, name, parent_id, path, created_at FROM categories WHERE id = $1`, id))
+}
+
+// ListCategories returns the categories under parentID and all their
+// descendants, or every category if parentID is 0, in path order so that
+// each category follows its parent.
+func (c *CategoryRepository) ListCategories(ctx context.Context, parentID int) ([]Category, error) {
+	query := `SELECT id, name, parent_id, path, created_at FROM categories
+              WHERE $1 = 0 OR (id <> $1 AND id IN ` + categorySubtree("id = $1") + `)
+              ORDER BY LOWER(path)`
+
+	rows, err := c.DB.QueryContext(ctx, query, parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	return categories, rows.Err()
+}
+
+// resolveCategory returns the id and path of the category with the given id,
+// or with the given path if id is 0. It returns ErrUnknownCategory if there
+// is no such category.
+func resolveCategory(ctx context.Context, q queryRower, id int, path string) (int, string, error) {
+	query := `SELECT id, path FROM categories WHERE id = $1`
+	arg := interface{}(id)
+	if id == 0 {
+		query = `SELECT id, path FROM categories WHERE LOWER(path) = LOWER($1)`
+		arg = NormalizeCategoryPath(path)
+	}
+
+	err := q.QueryRowContext(ctx, query, arg).Scan(&id, &path)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrUnknownCategory
+	}
+	return id, path, err
+}
@@ -3,25 +3,98 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/patrickmn/go-cache"
 )
 
+type UsageType string
+
+const (
+	UsageOneTime   UsageType = "one-time"
+	UsageMultiUse  UsageType = "multi-use"
+	UsageTimeBased UsageType = "time-based"
+)
+
+func (u UsageType) Valid() bool {
+	return u == UsageOneTime || u == UsageMultiUse || u == UsageTimeBased
+}
+
+type DiscountType string
+
+const (
+	DiscountFixed      DiscountType = "fixed"
+	DiscountPercentage DiscountType = "percentage"
+)
+
+func (d DiscountType) Valid() bool {
+	return d == DiscountFixed || d == DiscountPercentage
+}
+
+var ErrDuplicateCode = errors.New("a coupon with the same code already exists")
+
+// NormalizeCode returns the form coupon codes are matched and kept unique
+// by: upper case, with whitespace and separators removed, so that "save20",
+// " SAVE20 " and "SAVE-20" are the same code. The code as entered is kept as
+// the display form. Only ASCII letters and whitespace are folded, the same
+// as the SQL that backfilled existing codes, since the database's case
+// mapping depends on its locale.
+func NormalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\v' || r == '\f' || r == '\r' || r == '-' || r == '_' || r == '.':
+			return -1
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return r
+	}, code)
+}
+
 type Coupon struct {
-	CouponCode           string    `json:"coupon_code"`
-	ExpiryDate           time.Time `json:"expiry_date"`
-	UsageType            string    `json:"usage_type"` // one-time / multi-use
-	ApplicableMedicines  []string  `json:"applicable_medicine_ids,omitempty"`
-	ApplicableCategories []string  `json:"applicable_categories"`
-	MinOrderValue        float64   `json:"min_order_value"`
-	ValidTimeWindow      string    `json:"valid_time_window,omitempty"`
-	TermsAndConditions   string    `json:"terms_and_conditions,omitempty"`
-	DiscountType         string    `json:"discount_type"`  // fixed / percentage
-	DiscountValue        float64   `json:"discount_value"` // amount / percentage
-	MaxUsagePerUser      int       `json:"max_usage_per_user"`
+	CouponCode            string       `json:"coupon_code"`
+	ExpiryDate            time.Time    `json:"expiry_date"`
+	UsageType             UsageType    `json:"usage_type"` // one-time / multi-use / time-based
+	ApplicableMedicines   []string     `json:"applicable_medicine_ids,omitempty"`
+	ApplicableCategories  []string     `json:"applicable_categories"` // category paths; also covers their subcategories
+	ApplicableCategoryIDs []int        `json:"applicable_category_ids"`
+	MinOrderValue         float64      `json:"min_order_value"`
+	ValidTimeWindow       string       `json:"valid_time_window,omitempty"`
+	TermsAndConditions    string       `json:"terms_and_conditions,omitempty"`
+	DiscountType          DiscountType `json:"discount_type"`  // fixed / percentage
+	DiscountValue         float64      `json:"discount_value"` // amount / percentage
+	MaxUsagePerUser       int          `json:"max_usage_per_user"`
+	AutoApply             bool         `json:"auto_apply"` // applied to qualifying carts without a code
+	Stackable             bool         `json:"stackable"`  // can be combined with other coupons
+	PaymentMethods        []string     `json:"allowed_payment_methods,omitempty"`
+	Channels              []string     `json:"allowed_channels,omitempty"` // app / web / pos
+	MinAppVersion         string       `json:"min_app_version,omitempty"`
+	Region                Region       `json:"region"`
+	EligibilityRule       string       `json:"eligibility_rule,omitempty"`  // rules expression, e.g. cart.total >= 500
+	MaxDiscount           float64      `json:"max_discount,omitempty"`      // cap on the discount per order, 0 for none
+	Budget                float64      `json:"budget,omitempty"`            // planned total campaign spend, 0 for none
+	ConsumeOnCancel       bool         `json:"consume_on_cancel,omitempty"` // cancelled or refunded orders still use up the coupon
+	Status                string       `json:"status,omitempty"`            // draft / pending_approval / approved / rejected / live
+}
+
+// Region targets a coupon at delivery locations. An empty region applies
+// everywhere; with Exclude set the listed locations are excluded instead.
+type Region struct {
+	Pincodes []string `json:"pincodes,omitempty"`
+	Cities   []string `json:"cities,omitempty"`
+	States   []string `json:"states,omitempty"`
+	Exclude  bool     `json:"exclude,omitempty"`
+}
+
+type DeliveryRegion struct {
+	Pincode string `json:"pincode"`
+	City    string `json:"city"`
+	State   string `json:"state"`
 }
 
 type CouponRequest struct {
@@ -29,6 +102,14 @@ type CouponRequest struct {
 	OrderTotal float64    `json:"order_total"`
 	Timestamp  string     `json:"timestamp"`
 	CouponCode string     `json:"coupon_code"`
+
+	PaymentMethod string `json:"payment_method,omitempty"`
+	Channel       string `json:"channel,omitempty"`
+	AppVersion    string `json:"app_version,omitempty"`
+
+	DeliveryRegion *DeliveryRegion `json:"delivery_region,omitempty"`
+
+	Signals Signals `json:"signals"` // identify the person behind the account, for abuse checks
 }
 
 type CartItem struct {
@@ -41,140 +122,482 @@ type CartItem struct {
 type CouponResult struct {
 	CouponCode    string `json:"coupon_code"`
 	DiscountValue string `json:"discount_value"`
+	AutoApplied   bool   `json:"auto_applied,omitempty"`
+}
+
+type AppliedCoupon struct {
+	CouponCode      string  `json:"coupon_code"`
+	ItemsDiscount   float64 `json:"items_discount"`
+	ChargesDiscount float64 `json:"charges_discount"`
+	Stackable       bool    `json:"-"`
+}
+
+const couponColumns = `coupon_code, expiry_date, usage_type, min_order_value, discount_type, discount_value, max_usage_per_user, auto_apply, stackable, allowed_payment_methods, allowed_channels, min_app_version, region_pincodes, region_cities, region_states, region_exclude, eligibility_rule, max_discount, budget, consume_on_cancel`
+
+// couponSelectColumns adds the fields that are managed by the approval
+// workflow, and the categories and items the coupon applies to, which are
+// kept in join tables. It must select from coupons without an alias.
+const couponSelectColumns = couponColumns + `, status,
+    ARRAY(SELECT cc.category_id FROM coupon_categories cc WHERE cc.coupon_code = coupons.coupon_code ORDER BY cc.position),
+    ARRAY(SELECT c.path FROM coupon_categories cc JOIN categories c ON c.id = cc.category_id
+          WHERE cc.coupon_code = coupons.coupon_code ORDER BY cc.position),
+    ARRAY(SELECT ci.item_id::text FROM coupon_items ci WHERE ci.coupon_code = coupons.coupon_code ORDER BY ci.position)`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	queryRower
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func scanCoupon(row rowScanner) (Coupon, error) {
+	var coupon Coupon
+	var paymentMethods, channels, minAppVersion sql.NullString
+	var pincodes, cities, states, eligibilityRule sql.NullString
+	var categoryIDs pq.Int64Array
+	var categories, items pq.StringArray
+	err := row.Scan(&coupon.CouponCode, &coupon.ExpiryDate, &coupon.UsageType, &coupon.MinOrderValue, &coupon.DiscountType, &coupon.DiscountValue, &coupon.MaxUsagePerUser, &coupon.AutoApply, &coupon.Stackable, &paymentMethods, &channels, &minAppVersion,
+		&pincodes, &cities, &states, &coupon.Region.Exclude, &eligibilityRule, &coupon.MaxDiscount, &coupon.Budget, &coupon.ConsumeOnCancel, &coupon.Status,
+		&categoryIDs, &categories, &items)
+	if err != nil {
+		return coupon, err
+	}
+	coupon.ApplicableCategories = categories
+	coupon.ApplicableMedicines = items
+	coupon.ApplicableCategoryIDs = make([]int, len(categoryIDs))
+	for i, id := range categoryIDs {
+		coupon.ApplicableCategoryIDs[i] = int(id)
+	}
+	coupon.PaymentMethods = splitCommaSeparatedString(paymentMethods.String)
+	coupon.Channels = splitCommaSeparatedString(channels.String)
+	coupon.MinAppVersion = minAppVersion.String
+	coupon.Region.Pincodes = splitCommaSeparatedString(pincodes.String)
+	coupon.Region.Cities = splitCommaSeparatedString(cities.String)
+	coupon.Region.States = splitCommaSeparatedString(states.String)
+	coupon.EligibilityRule = eligibilityRule.String
+	return coupon, nil
 }
 
 type CouponRepository struct {
-	DB    *sql.DB
-	Cache *cache.Cache
+	DB       *sql.DB
+	Cache    *cache.Cache
+	Approval ApprovalPolicy
+	Abuse    AbusePolicy
+
+	// RejectOutOfStock makes validation reject carts with items that have no
+	// stock left
+	RejectOutOfStock bool
 }
 
-func NewCouponRepository(db *sql.DB) *CouponRepository {
+func NewCouponRepository(db *sql.DB, approval ApprovalPolicy, abuse AbusePolicy) *CouponRepository {
 	c := cache.New(20*time.Minute, 30*time.Minute) // 5 min TTL
-	return &CouponRepository{DB: db, Cache: c}
+	return &CouponRepository{DB: db, Cache: c, Approval: approval, Abuse: abuse}
 }
 
 func (r *CouponRepository) CreateCoupon(ctx context.Context, coupon Coupon) error {
-	query := `INSERT INTO coupons (coupon_code, expiry_date, usage_type, applicable_categories, min_order_value, discount_type, discount_value, max_usage_per_user) 
-              VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	applicableCategories := strings.Join(coupon.ApplicableCategories, ",")
+	if err := createCoupon(ctx, tx, coupon); err != nil {
+		return err
+	}
 
-	_, err := r.DB.ExecContext(ctx, query, coupon.CouponCode, coupon.ExpiryDate, coupon.UsageType, applicableCategories, coupon.MinOrderValue, coupon.DiscountType, coupon.DiscountValue, coupon.MaxUsagePerUser)
+	err = tx.Commit()
 	if err == nil {
 		r.Cache.Delete("all_coupons") // Invalidate the cache
 	}
 	return err
 }
 
+func createCoupon(ctx context.Context, tx *sql.Tx, coupon Coupon) error {
+	query := `INSERT INTO coupons (` + couponColumns + `, normalized_code) 
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)`
+
+	coupon.CouponCode = strings.TrimSpace(coupon.CouponCode)
+	normalized := NormalizeCode(coupon.CouponCode)
+
+	if _, err := lookupCouponCode(ctx, tx, normalized); err == nil {
+		return ErrDuplicateCode
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	if err := resolveCouponApplicability(ctx, tx, &coupon); err != nil {
+		return err
+	}
+
+	// A concurrent create of the same code gets past the lookup above and
+	// fails on the unique index instead
+	_, err := tx.ExecContext(ctx, query, append(couponArgs(coupon), normalized)...)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicateCode
+	} else if err != nil {
+		return err
+	}
+	if err := writeCouponApplicability(ctx, tx, coupon); err != nil {
+		return err
+	}
+	return insertCouponVersion(ctx, tx, coupon)
+}
+
+// UpdateCoupon replaces the coupon's rules and records them as a new version.
+// Approved or live coupons that now need approval go back to draft. It
+// returns sql.ErrNoRows if the coupon does not exist.
+func (r *CouponRepository) UpdateCoupon(ctx context.Context, coupon Coupon, actor string) error {
+	query := `UPDATE coupons SET (` + couponColumns + `) 
+              = ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+              WHERE coupon_code = $1`
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The code in the request may be in any form; keep the stored display form
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT coupon_code, status FROM coupons WHERE normalized_code = $1 FOR UPDATE`,
+		NormalizeCode(coupon.CouponCode)).Scan(&coupon.CouponCode, &status)
+	if err != nil {
+		return err
+	}
+
+	if err := resolveCouponApplicability(ctx, tx, &coupon); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, query, couponArgs(coupon)...); err != nil {
+		return err
+	}
+	if err := writeCouponApplicability(ctx, tx, coupon); err != nil {
+		return err
+	}
+	if err := insertCouponVersion(ctx, tx, coupon); err != nil {
+		return err
+	}
+
+	if (status == StatusApproved || status == StatusLive) && r.Approval.RequiresApproval(coupon) {
+		if err := setCouponStatus(ctx, tx, coupon.CouponCode, status, StatusDraft, actor, "rules changed, approval required"); err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		r.Cache.Delete("all_coupons") // Invalidate the cache
+	}
+	return err
+}
+
+// lookupCouponCode returns the display form of the coupon with the given
+// normalized code, or sql.ErrNoRows.
+func lookupCouponCode(ctx context.Context, q queryRower, normalized string) (string, error) {
+	var code string
+	err := q.QueryRowContext(ctx, `SELECT coupon_code FROM coupons WHERE normalized_code = $1`, normalized).Scan(&code)
+	return code, err
+}
+
+// couponArgs returns the query arguments matching couponColumns.
+func couponArgs(coupon Coupon) []interface{} {
+	return []interface{}{
+		coupon.CouponCode, coupon.ExpiryDate, coupon.UsageType, coupon.MinOrderValue,
+		coupon.DiscountType, coupon.DiscountValue, coupon.MaxUsagePerUser, coupon.AutoApply, coupon.Stackable,
+		strings.Join(coupon.PaymentMethods, ","), strings.Join(coupon.Channels, ","), coupon.MinAppVersion,
+		strings.Join(coupon.Region.Pincodes, ","), strings.Join(coupon.Region.Cities, ","), strings.Join(coupon.Region.States, ","), coupon.Region.Exclude,
+		coupon.EligibilityRule, coupon.MaxDiscount, coupon.Budget, coupon.ConsumeOnCancel,
+	}
+}
+
 func (r *CouponRepository) GetCoupons(ctx context.Context, couponReq CouponRequest) ([]CouponResult, error) {
-	query := `SELECT coupon_code, expiry_date, usage_type, applicable_categories, min_order_value, discount_type, discount_value, max_usage_per_user 
+	query := `SELECT ` + couponSelectColumns + ` 
 			  FROM coupons
-			  WHERE expiry_date > $1 AND min_order_value <= $2`
+			  WHERE status = 'live' AND expiry_date > $1 AND min_order_value <= $2
+			  AND NOT EXISTS (SELECT 1 FROM user_coupons uc WHERE uc.coupon_code = coupons.coupon_code)
+			  AND ` + couponCoversCart("$3")
 
 	// Calculate the total price of all cart items
 	var totalPrice float64
 	for _, item := range couponReq.CartItems {
 		totalPrice += item.Price
 	}
-	rows, err := r.DB.QueryContext(ctx, query, couponReq.Timestamp, totalPrice)
+	rows, err := r.DB.QueryContext(ctx, query, requestTime(couponReq), totalPrice, pq.Array(cartCategoryPaths(couponReq.CartItems)))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var applicableCoupons []CouponResult
+	var autoApplied []AppliedCoupon
 
 	for rows.Next() {
-		var coupon Coupon
-		var applicableCategories string
-		err := rows.Scan(&coupon.CouponCode, &coupon.ExpiryDate, &coupon.UsageType, &applicableCategories, &coupon.MinOrderValue, &coupon.DiscountType, &coupon.DiscountValue, &coupon.MaxUsagePerUser)
+		coupon, err := scanCoupon(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		// Check if the coupon is applicable to the cart items
-		coupon.ApplicableCategories = splitCommaSeparatedString(applicableCategories)
-		isApplicable := false
-		for _, item := range couponReq.CartItems {
-			if containsString(coupon.ApplicableCategories, item.Category) {
-				isApplicable = true
-				break
-			}
-		}
-		if !isApplicable {
+		// Check if the coupon is applicable to the cart items and request context.
+		// Checks that depend on the user are only enforced at validation.
+		if evaluateCoupon(coupon, couponReq, nil) != "" {
 			continue
 		}
 
 		// Calculate the discount
 		var discountValue float64
-		if coupon.DiscountType == "percentage" {
+		if coupon.DiscountType == DiscountPercentage {
 			discountValue = (couponReq.OrderTotal * coupon.DiscountValue) / 100
-		} else if coupon.DiscountType == "fixed" {
+		} else if coupon.DiscountType == DiscountFixed {
 			discountValue = coupon.DiscountValue
 		}
+		if coupon.MaxDiscount > 0 && discountValue > coupon.MaxDiscount {
+			discountValue = coupon.MaxDiscount
+		}
 
 		discountStr := strconv.FormatFloat(discountValue, 'f', 2, 64)
 
 		applicableCoupons = append(applicableCoupons, CouponResult{
 			CouponCode:    coupon.CouponCode,
 			DiscountValue: discountStr,
+			AutoApplied:   coupon.AutoApply,
 		})
+		if coupon.AutoApply {
+			autoApplied = append(autoApplied, toAppliedCoupon(coupon, couponReq))
+		}
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return applicableCoupons, nil
+	return stackAutoApplied(applicableCoupons, autoApplied), nil
 }
 
-func (r *CouponRepository) CheckCoupon(ctx context.Context, couponReq CouponRequest, userID string) (float64, float64, error) {
-	query := `SELECT coupon_code, expiry_date, usage_type, applicable_categories, min_order_value, discount_type, discount_value, max_usage_per_user 
-			  FROM coupons
-			  WHERE coupon_code = $1 AND min_order_value <= $2 AND expiry_date > $3`
+// stackAutoApplied drops the automatic promotions that would not be applied
+// together, as resolveStacking picks them when no code is entered.
+func stackAutoApplied(results []CouponResult, auto []AppliedCoupon) []CouponResult {
+	applied := map[string]bool{}
+	for _, c := range resolveStacking(nil, auto) {
+		applied[c.CouponCode] = true
+	}
 
-	// Calculate the total price of all cart items
-	var totalPrice float64
-	for _, item := range couponReq.CartItems {
-		totalPrice += item.Price
+	var kept []CouponResult
+	for _, res := range results {
+		if res.AutoApplied && !applied[res.CouponCode] {
+			continue
+		}
+		kept = append(kept, res)
 	}
-	var coupon Coupon
-	var applicableCategories string
-	err := r.DB.QueryRowContext(ctx, query, couponReq.CouponCode, totalPrice, couponReq.Timestamp).
-		Scan(&coupon.CouponCode, &coupon.ExpiryDate, &coupon.UsageType, &applicableCategories, &coupon.MinOrderValue, &coupon.DiscountType, &coupon.DiscountValue, &coupon.MaxUsagePerUser)
-	if err != nil {
+	return kept
+}
+
+func (r *CouponRepository) CheckCoupon(ctx context.Context, couponReq CouponRequest, userID int) (float64, float64, error) {
+	coupon, _, err := r.checkCoupon(ctx, r.DB, couponReq, userID)
+	if err != nil || coupon == nil {
 		return 0, 0, err
 	}
 
-	// Check if the coupon is applicable to the cart items
-	coupon.ApplicableCategories = splitCommaSeparatedString(applicableCategories)
-	isApplicable := false
-	for _, item := range couponReq.CartItems {
-		if containsString(coupon.ApplicableCategories, item.Category) {
-			isApplicable = true
-			break
+	itemsDiscount, chargesDiscount := calculateDiscount(*coupon, couponReq)
+	return itemsDiscount, chargesDiscount, nil
+}
+
+// checkCoupon runs every eligibility check for couponReq.CouponCode and
+// returns the coupon, or nil and the rejection reason if it cannot be
+// redeemed by userID. Every query runs on q, so that an order's transaction
+// sees the same state it is placed against.
+func (r *CouponRepository) checkCoupon(ctx context.Context, q queryRower, couponReq CouponRequest, userID int) (*Coupon, string, error) {
+	query := `SELECT ` + couponSelectColumns + ` FROM coupons WHERE normalized_code = $1 AND status = 'live'`
+
+	coupon, err := scanCoupon(q.QueryRowContext(ctx, query, NormalizeCode(couponReq.CouponCode)))
+	if err == sql.ErrNoRows {
+		return nil, ReasonNotFound, nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	user, err := r.loadRedeemer(ctx, q, coupon.CouponCode, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if reason := evaluateCoupon(coupon, couponReq, &user); reason != "" {
+		return nil, reason, nil
+	}
+
+	if r.RejectOutOfStock {
+		out, err := cartOutOfStock(ctx, q, couponReq.CartItems, userID)
+		if err != nil {
+			return nil, "", err
+		}
+		if out {
+			return nil, ReasonOutOfStock, nil
 		}
 	}
-	if !isApplicable {
-		return 0, 0, nil
+
+	// Coupons issued to specific users can only be redeemed from their wallet
+	allowed, err := r.checkUserCoupon(ctx, q, coupon.CouponCode, userID, user.CouponUses, requestTime(couponReq))
+	if err != nil {
+		return nil, "", err
+	}
+	if !allowed {
+		return nil, ReasonNotIssuedToUser, nil
 	}
 
-	// Check if the coupon is a one-time usage or multi-use usage type
-	usageCheckQuery := `SELECT COUNT(*) FROM orders WHERE coupon_code_used = $1 AND user_id = $2`
-	var usageCount int
-	err = r.DB.QueryRowContext(ctx, usageCheckQuery, couponReq.CouponCode, userID).Scan(&usageCount)
+	reason, err := r.checkAbuse(ctx, q, coupon.CouponCode, user.UserID, couponReq.Signals)
 	if err != nil {
-		return 0, 0, err
+		return nil, "", err
+	}
+	if reason != "" {
+		return nil, reason, nil
 	}
 
-	if coupon.UsageType == "one-time" {
-		if usageCount >= 1 {
-			return 0, 0, nil
+	return &coupon, "", nil
+}
+
+type CartValidation struct {
+	Entered     *AppliedCoupon  // nil if no code was given or it was rejected
+	Reason      string          // why the entered code was rejected
+	AutoApplied []AppliedCoupon // automatic promotions applied alongside
+}
+
+// ValidateCart checks the explicitly entered coupon (if any) and collects the
+// automatic promotions that apply alongside it.
+func (r *CouponRepository) ValidateCart(ctx context.Context, couponReq CouponRequest, userID int) (CartValidation, error) {
+	return r.validateCart(ctx, r.DB, couponReq, userID)
+}
+
+// validateCart is ValidateCart running every query on q. PlaceOrder uses it
+// to apply the same coupons that validation shows.
+func (r *CouponRepository) validateCart(ctx context.Context, q querier, couponReq CouponRequest, userID int) (CartValidation, error) {
+	var res CartValidation
+	if couponReq.CouponCode != "" {
+		coupon, reason, err := r.checkCoupon(ctx, q, couponReq, userID)
+		if err != nil {
+			return res, err
+		}
+		if coupon != nil {
+			applied := toAppliedCoupon(*coupon, couponReq)
+			res.Entered = &applied
 		}
+		res.Reason = reason
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT coupon_code FROM coupons WHERE auto_apply AND status = 'live' AND expiry_date > $1`, requestTime(couponReq))
+	if err != nil {
+		return res, err
+	}
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return res, err
+		}
+		codes = append(codes, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+
+	var auto []AppliedCoupon
+	for _, code := range codes {
+		if res.Entered != nil && code == res.Entered.CouponCode {
+			continue
+		}
+		autoReq := couponReq
+		autoReq.CouponCode = code
+		coupon, _, err := r.checkCoupon(ctx, q, autoReq, userID)
+		if err != nil {
+			return res, err
+		}
+		if coupon != nil {
+			auto = append(auto, toAppliedCoupon(*coupon, autoReq))
+		}
+	}
+
+	res.AutoApplied = resolveStacking(res.Entered, auto)
+	return res, nil
+}
+
+func toAppliedCoupon(coupon Coupon, couponReq CouponRequest) AppliedCoupon {
+	itemsDiscount, chargesDiscount := calculateDiscount(coupon, couponReq)
+	return AppliedCoupon{
+		CouponCode:      coupon.CouponCode,
+		ItemsDiscount:   itemsDiscount,
+		ChargesDiscount: chargesDiscount,
+		Stackable:       coupon.Stackable,
+	}
+}
+
+// resolveStacking picks which automatic promotions can be combined with the
+// entered coupon. Non-stackable coupons are exclusive: an exclusive entered
+// coupon suppresses every promotion, and without an entered coupon the best
+// exclusive promotion wins only if it beats all stackable ones combined.
+func resolveStacking(entered *AppliedCoupon, auto []AppliedCoupon) []AppliedCoupon {
+	if entered != nil && !entered.Stackable {
+		return nil
+	}
+
+	var stackable []AppliedCoupon
+	var stackableTotal float64
+	var bestExclusive *AppliedCoupon
+	for i, c := range auto {
+		if c.Stackable {
+			stackable = append(stackable, c)
+			stackableTotal += c.ItemsDiscount + c.ChargesDiscount
+		} else if bestExclusive == nil || c.ItemsDiscount+c.ChargesDiscount > bestExclusive.ItemsDiscount+bestExclusive.ChargesDiscount {
+			bestExclusive = &auto[i]
+		}
+	}
+
+	if entered == nil && bestExclusive != nil && bestExclusive.ItemsDiscount+bestExclusive.ChargesDiscount > stackableTotal {
+		return []AppliedCoupon{*bestExclusive}
+	}
+	return stackable
+}
+
+// calculateDiscount splits the coupon's discount between the cart items and
+// the remaining order charges, scaled down proportionally to the coupon's cap.
+// Neither part ever exceeds what it discounts, so the total is capped at the
+// order total.
+func calculateDiscount(coupon Coupon, couponReq CouponRequest) (float64, float64) {
+	itemsDiscount, chargesDiscount := uncappedDiscount(coupon, couponReq)
+
+	total := itemsDiscount + chargesDiscount
+	if coupon.MaxDiscount > 0 && total > coupon.MaxDiscount {
+		scale := coupon.MaxDiscount / total
+		itemsDiscount *= scale
+		chargesDiscount *= scale
+	}
+
+	var totalPrice float64
+	for _, item := range couponReq.CartItems {
+		totalPrice += item.Price
+	}
+	itemsDiscount = math.Min(itemsDiscount, totalPrice)
+	chargesDiscount = math.Min(chargesDiscount, math.Max(0, couponReq.OrderTotal-totalPrice))
+	return itemsDiscount, chargesDiscount
+}
+
+func uncappedDiscount(coupon Coupon, couponReq CouponRequest) (float64, float64) {
+	var totalPrice float64
+	for _, item := range couponReq.CartItems {
+		totalPrice += item.Price
 	}
 
 	var itemsDiscount, chargesDiscount float64
-	if coupon.DiscountType == "percentage" {
+	if coupon.DiscountType == DiscountPercentage {
 		discountValue := coupon.DiscountValue
 
 		// Items discount
@@ -184,25 +607,26 @@ func (r *CouponRepository) CheckCoupon(ctx context.Context, couponReq CouponRequ
 		totalCharges := couponReq.OrderTotal - totalPrice
 		chargesDiscount = totalCharges * (discountValue / 100)
 
-		return itemsDiscount, chargesDiscount, nil
-	} else if coupon.DiscountType == "fixed" {
+		return itemsDiscount, chargesDiscount
+	} else if coupon.DiscountType == DiscountFixed {
 		fixedDiscount := coupon.DiscountValue
 
-		totalCharges := couponReq.OrderTotal - totalPrice
+		totalCharges := math.Max(0, couponReq.OrderTotal-totalPrice)
 		if fixedDiscount >= totalCharges {
-			// Apply the entire fixed discount to the charges and set the items discount to 0
-			chargesDiscount = fixedDiscount
-			itemsDiscount = 0
+			// Cover the charges and book what is left of the fixed discount
+			// against the items, so a cart without charges still gets it
+			chargesDiscount = totalCharges
+			itemsDiscount = fixedDiscount - totalCharges
 		} else {
 			// Apply the fixed discount to both the items and the charges
 			itemsDiscount = fixedDiscount
 			chargesDiscount = fixedDiscount
 		}
 
-		return itemsDiscount, chargesDiscount, nil
+		return itemsDiscount, chargesDiscount
 	}
 
-	return itemsDiscount, chargesDiscount, nil
+	return itemsDiscount, chargesDiscount
 }
 
 func (r *CouponRepository) GetAllCoupons(ctx context.Context) ([]Coupon, error) {
@@ -210,7 +634,7 @@ func (r *CouponRepository) GetAllCoupons(ctx context.Context) ([]Coupon, error)
 		return cached.([]Coupon), nil
 	}
 
-	rows, err := r.DB.QueryContext(ctx, `SELECT coupon_code, expiry_date, usage_type, applicable_categories, min_order_value, discount_type, discount_value, max_usage_per_user FROM coupons`)
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+couponSelectColumns+` FROM coupons WHERE status = 'live'`)
 	if err != nil {
 		return nil, err
 	}
@@ -218,13 +642,11 @@ func (r *CouponRepository) GetAllCoupons(ctx context.Context) ([]Coupon, error)
 
 	var coupons []Coupon
 	for rows.Next() {
-		var coupon Coupon
-		var applicableCategories string
-		if err := rows.Scan(&coupon.CouponCode, &coupon.ExpiryDate, &coupon.UsageType, &applicableCategories, &coupon.MinOrderValue, &coupon.DiscountType, &coupon.DiscountValue, &coupon.MaxUsagePerUser); err != nil {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
 			return nil, err
 		}
 
-		coupon.ApplicableCategories = splitCommaSeparatedString(applicableCategories)
 		coupons = append(coupons, coupon)
 	}
 
@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// UnknownReferenceError is returned when a coupon lists a category or item
+// that does not exist.
+type UnknownReferenceError struct {
+	Pointer string // JSON pointer to the offending value
+	Message string
+}
+
+func (e *UnknownReferenceError) Error() string {
+	return e.Message
+}
+
+// resolveCouponApplicability checks that the categories and items the coupon
+// applies to exist. It sets both ApplicableCategoryIDs and
+// ApplicableCategories to the categories, without repeats, taking them from
+// ApplicableCategoryIDs if it is set and looking them up by path otherwise.
+// It returns an *UnknownReferenceError for the first one that does not exist.
+func resolveCouponApplicability(ctx context.Context, q queryRower, coupon *Coupon) error {
+	ids := []int{}
+	paths := []string{}
+	seen := map[int]bool{}
+	add := func(pointer, name string, id int, path string) error {
+		id, path, err := resolveCategory(ctx, q, id, path)
+		if err == ErrUnknownCategory {
+			return &UnknownReferenceError{Pointer: pointer, Message: "unknown category " + name}
+		} else if err != nil {
+			return err
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+			paths = append(paths, path)
+		}
+		return nil
+	}
+
+	if len(coupon.ApplicableCategoryIDs) > 0 {
+		for i, id := range coupon.ApplicableCategoryIDs {
+			if err := add("/applicable_category_ids/"+strconv.Itoa(i), strconv.Itoa(id), id, ""); err != nil {
+				return err
+			}
+		}
+	} else {
+		for i, path := range coupon.ApplicableCategories {
+			if err := add("/applicable_categories/"+strconv.Itoa(i), path, 0, path); err != nil {
+				return err
+			}
+		}
+	}
+	coupon.ApplicableCategoryIDs, coupon.ApplicableCategories = ids, paths
+
+	items := []string{}
+	seenItems := map[int]bool{}
+	for i, v := range coupon.ApplicableMedicines {
+		unknown := &UnknownReferenceError{Pointer: "/applicable_medicine_ids/" + strconv.Itoa(i), Message: "unknown item " + v}
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return unknown
+		}
+
+		var exists bool
+		if err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM items WHERE id = $1 AND deleted_at IS NULL)`, id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return unknown
+		}
+		if !seenItems[id] {
+			seenItems[id] = true
+			items = append(items, strconv.Itoa(id))
+		}
+	}
+	coupon.ApplicableMedicines = items
+	return nil
+}
+
+// ResolveApplicability resolves the coupon's categories and items like
+// CreateCoupon does, without storing anything, for coupons that are only
+// simulated or backtested. It returns an *UnknownReferenceError for the
+// first one that does not exist.
+func (r *CouponRepository) ResolveApplicability(ctx context.Context, coupon *Coupon) error {
+	return resolveCouponApplicability(ctx, r.DB, coupon)
+}
+
+// writeCouponApplicability replaces the coupon's rows in coupon_categories and
+// coupon_items with its resolved categories and items.
+func writeCouponApplicability(ctx context.Context, tx *sql.Tx, coupon Coupon) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM coupon_categories WHERE coupon_code = $1`, coupon.CouponCode); err != nil {
+		return err
+	}
+	for i, id := range coupon.ApplicableCategoryIDs {
+		_, err := tx.ExecContext(ctx, `INSERT INTO coupon_categories (coupon_code, category_id, position) VALUES ($1, $2, $3)`,
+			coupon.CouponCode, id, i+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM coupon_items WHERE coupon_code = $1`, coupon.CouponCode); err != nil {
+		return err
+	}
+	for i, id := range coupon.ApplicableMedicines {
+		_, err := tx.ExecContext(ctx, `INSERT INTO coupon_items (coupon_code, item_id, position) VALUES ($1, $2, $3)`,
+			coupon.CouponCode, id, i+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// couponCoversCart matches coupons on a category of the cart or an ancestor of
+// one, like categoryCovers. categoriesParam must hold the cart's category
+// paths, normalized and lower-cased.
+func couponCoversCart(categoriesParam string) string {
+	return `EXISTS (SELECT 1 FROM coupon_categories cc
+                    WHERE cc.coupon_code = coupons.coupon_code
+                      AND cc.category_id IN (WITH RECURSIVE ancestors AS (
+                              SELECT id, parent_id FROM categories WHERE LOWER(path) = ANY(` + categoriesParam + `)
+                              UNION
+                              SELECT p.id, p.parent_id FROM categories p JOIN ancestors a ON p.id = a.parent_id)
+                          SELECT id FROM ancestors))`
+}
+
+// cartCategoryPaths returns the cart's category paths for couponCoversCart.
+func cartCategoryPaths(items []CartItem) []string {
+	paths := []string{}
+	for _, item := range items {
+		if path := strings.ToLower(NormalizeCategoryPath(item.Category)); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+)
+
+type ImportRow struct {
+	Row    int
+	Coupon Coupon
+	Err    error // set when the row could not be parsed or is invalid
+}
+
+type ImportResult struct {
+	Row        int    `json:"row"`
+	CouponCode string `json:"coupon_code,omitempty"`
+	Created    bool   `json:"created"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ImportCoupons creates every valid row in a single transaction. Rows that
+// fail are reported and skipped without affecting the others; in dry-run mode
+// the transaction is rolled back after every row has been checked.
+func (r *CouponRepository) ImportCoupons(ctx context.Context, rows []ImportRow, dryRun bool) ([]ImportResult, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]ImportResult, 0, len(rows))
+	for _, row := range rows {
+		result := ImportResult{Row: row.Row, CouponCode: row.Coupon.CouponCode}
+
+		err := row.Err
+		if err == nil {
+			err = createCouponSavepoint(ctx, tx, row.Coupon)
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Created = !dryRun
+		}
+		results = append(results, result)
+	}
+
+	if dryRun {
+		return results, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Cache.Delete("all_coupons") // Invalidate the cache
+	return results, nil
+}
+
+// createCouponSavepoint creates the coupon inside a savepoint so a failing
+// row does not abort the surrounding transaction.
+func createCouponSavepoint(ctx context.Context, tx *sql.Tx, coupon Coupon) error {
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT import_row`); err != nil {
+		return err
+	}
+	if err := createCoupon(ctx, tx, coupon); err != nil {
+		if _, rbErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT import_row`); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT import_row`)
+	return err
+}
+
+// ExportCoupons calls fn for every coupon in code order, streaming rows from
+// the database rather than loading them all at once.
+func (r *CouponRepository) ExportCoupons(ctx context.Context, fn func(Coupon) error) error {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+couponSelectColumns+` FROM coupons ORDER BY coupon_code`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(coupon); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// CouponTemplate is a saved rule set that coupons can be created from. The
+// definition carries no code, expiry or status of its own.
+type CouponTemplate struct {
+	Name       string    `json:"name"`
+	Definition Coupon    `json:"definition"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GetCoupon returns the coupon in any status, or sql.ErrNoRows.
+func (r *CouponRepository) GetCoupon(ctx context.Context, couponCode string) (Coupon, error) {
+	return scanCoupon(r.DB.QueryRowContext(ctx, `SELECT `+couponSelectColumns+` FROM coupons WHERE normalized_code = $1`, NormalizeCode(couponCode)))
+}
+
+// SaveTemplate creates or replaces the named template.
+func (r *CouponRepository) SaveTemplate(ctx context.Context, name string, coupon Coupon) error {
+	coupon.CouponCode = ""
+	coupon.ExpiryDate = time.Time{}
+	coupon.Status = ""
+
+	definition, err := json.Marshal(coupon)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO coupon_templates (name, definition, created_at) VALUES ($1, $2, $3)
+              ON CONFLICT (name) DO UPDATE SET definition = EXCLUDED.definition`
+	_, err = r.DB.ExecContext(ctx, query, name, definition, time.Now())
+	return err
+}
+
+// GetTemplate returns the named template, or sql.ErrNoRows.
+func (r *CouponRepository) GetTemplate(ctx context.Context, name string) (CouponTemplate, error) {
+	var t CouponTemplate
+	var definition []byte
+	err := r.DB.QueryRowContext(ctx, `SELECT name, definition, created_at FROM coupon_templates WHERE name = $1`, name).
+		Scan(&t.Name, &definition, &t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal(definition, &t.Definition)
+}
+
+func (r *CouponRepository) ListTemplates(ctx context.Context) ([]CouponTemplate, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT name, definition, created_at FROM coupon_templates ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []CouponTemplate
+	for rows.Next() {
+		var t CouponTemplate
+		var definition []byte
+		if err := rows.Scan(&t.Name, &definition, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(definition, &t.Definition); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return templates, nil
+}
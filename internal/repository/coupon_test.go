@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"SAVE20", "SAVE20"},
+		{"save20", "SAVE20"},
+		{" Save20 ", "SAVE20"},
+		{"SAVE-20", "SAVE20"},
+		{"save_20.off", "SAVE20OFF"},
+		{"save\t20\r\n", "SAVE20"},
+		{"\v\fsave", "SAVE"},
+		{"- _ .", ""},
+		// Only ASCII is folded, matching the SQL backfill
+		{"ça20", "çA20"},
+		{"ÇA20", "ÇA20"},
+		{"save\u00a020", "SAVE\u00a020"},
+		{"ﬁve", "ﬁVE"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeCode(tt.code); got != tt.want {
+			t.Errorf("NormalizeCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestCalculateDiscount(t *testing.T) {
+	cart := CouponRequest{
+		CartItems:  []CartItem{{ID: "1", Price: 300}, {ID: "2", Price: 200}},
+		OrderTotal: 600, // 100 of charges
+	}
+
+	tests := []struct {
+		name        string
+		coupon      Coupon
+		wantItems   float64
+		wantCharges float64
+	}{
+		{"percentage", Coupon{DiscountType: "percentage", DiscountValue: 10}, 50, 10},
+		{"percentage under cap", Coupon{DiscountType: "percentage", DiscountValue: 10, MaxDiscount: 100}, 50, 10},
+		// The cap is split in the same proportion as the uncapped discount
+		{"percentage capped", Coupon{DiscountType: "percentage", DiscountValue: 10, MaxDiscount: 30}, 25, 5},
+		{"fixed below charges", Coupon{DiscountType: "fixed", DiscountValue: 40}, 40, 40},
+		// What is left after covering the charges comes off the items
+		{"fixed covering charges", Coupon{DiscountType: "fixed", DiscountValue: 150}, 50, 100},
+		{"fixed capped", Coupon{DiscountType: "fixed", DiscountValue: 150, MaxDiscount: 60}, 20, 40},
+		{"fixed above order total", Coupon{DiscountType: "fixed", DiscountValue: 900}, 500, 100},
+		{"unknown type", Coupon{DiscountType: "bogus", DiscountValue: 10}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, charges := calculateDiscount(tt.coupon, cart)
+			if math.Abs(items-tt.wantItems) > 1e-9 || math.Abs(charges-tt.wantCharges) > 1e-9 {
+				t.Errorf("calculateDiscount = (%v, %v), want (%v, %v)", items, charges, tt.wantItems, tt.wantCharges)
+			}
+		})
+	}
+}
+
+func TestCalculateDiscountWithoutCharges(t *testing.T) {
+	cart := CouponRequest{
+		CartItems:  []CartItem{{ID: "1", Price: 300}, {ID: "2", Price: 200}},
+		OrderTotal: 500,
+	}
+
+	tests := []struct {
+		name      string
+		coupon    Coupon
+		wantItems float64
+	}{
+		{"percentage", Coupon{DiscountType: "percentage", DiscountValue: 10}, 50},
+		{"fixed", Coupon{DiscountType: "fixed", DiscountValue: 40}, 40},
+		{"fixed capped", Coupon{DiscountType: "fixed", DiscountValue: 40, MaxDiscount: 25}, 25},
+		{"fixed above order total", Coupon{DiscountType: "fixed", DiscountValue: 900}, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, charges := calculateDiscount(tt.coupon, cart)
+			if math.Abs(items-tt.wantItems) > 1e-9 || charges != 0 {
+				t.Errorf("calculateDiscount = (%v, %v), want (%v, 0)", items, charges, tt.wantItems)
+			}
+		})
+	}
+}
+
+func TestResolveStacking(t *testing.T) {
+	stackA := AppliedCoupon{CouponCode: "A", ItemsDiscount: 20, Stackable: true}
+	stackB := AppliedCoupon{CouponCode: "B", ChargesDiscount: 15, Stackable: true}
+	small := AppliedCoupon{CouponCode: "SMALL", ItemsDiscount: 30}
+	big := AppliedCoupon{CouponCode: "BIG", ItemsDiscount: 50}
+
+	tests := []struct {
+		name    string
+		entered *AppliedCoupon
+		auto    []AppliedCoupon
+		want    []AppliedCoupon
+	}{
+		{"exclusive entered suppresses all", &AppliedCoupon{CouponCode: "E"}, []AppliedCoupon{stackA, big}, nil},
+		{"stackable entered keeps stackable", &AppliedCoupon{CouponCode: "E", Stackable: true}, []AppliedCoupon{stackA, big, stackB}, []AppliedCoupon{stackA, stackB}},
+		{"stackable beat exclusive", nil, []AppliedCoupon{stackA, small, stackB}, []AppliedCoupon{stackA, stackB}},
+		{"best exclusive wins", nil, []AppliedCoupon{stackA, small, big, stackB}, []AppliedCoupon{big}},
+		{"nothing to apply", nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		if got := resolveStacking(tt.entered, tt.auto); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resolveStacking = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStackAutoApplied(t *testing.T) {
+	results := []CouponResult{
+		{CouponCode: "A", AutoApplied: true},
+		{CouponCode: "ENTER"},
+		{CouponCode: "BIG", AutoApplied: true},
+		{CouponCode: "SMALL", AutoApplied: true},
+	}
+	stackA := AppliedCoupon{CouponCode: "A", ItemsDiscount: 20, Stackable: true}
+	small := AppliedCoupon{CouponCode: "SMALL", ItemsDiscount: 10}
+	big := AppliedCoupon{CouponCode: "BIG", ItemsDiscount: 50}
+
+	// Coupons that have to be entered are always listed
+	want := []CouponResult{{CouponCode: "ENTER"}, {CouponCode: "BIG", AutoApplied: true}}
+	if got := stackAutoApplied(results, []AppliedCoupon{stackA, big, small}); !reflect.DeepEqual(got, want) {
+		t.Errorf("stackAutoApplied = %+v, want %+v", got, want)
+	}
+
+	want = []CouponResult{{CouponCode: "A", AutoApplied: true}, {CouponCode: "ENTER"}}
+	if got := stackAutoApplied(results[:3], []AppliedCoupon{stackA, {CouponCode: "BIG", ItemsDiscount: 15}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("stackAutoApplied = %+v, want %+v", got, want)
+	}
+}
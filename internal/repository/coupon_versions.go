@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+)
+
+type CouponVersion struct {
+	ID            int             `json:"id"`
+	CouponCode    string          `json:"coupon_code"`
+	Version       int             `json:"version"`
+	EffectiveFrom time.Time       `json:"effective_from"`
+	Definition    json.RawMessage `json:"definition"`
+	Changes       []FieldChange   `json:"changes,omitempty"` // compared to the previous version
+}
+
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// insertCouponVersion snapshots the coupon as its next immutable version,
+// effective immediately.
+func insertCouponVersion(ctx context.Context, tx *sql.Tx, coupon Coupon) error {
+	definition, err := json.Marshal(coupon)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO coupon_versions (coupon_code, version, definition, effective_from)
+              SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3 FROM coupon_versions WHERE coupon_code = $1`
+	_, err = tx.ExecContext(ctx, query, coupon.CouponCode, definition, time.Now())
+	return err
+}
+
+// GetCouponHistory lists every version of the coupon, oldest first, with the
+// fields that changed from the version before it.
+func (r *CouponRepository) GetCouponHistory(ctx context.Context, couponCode string) ([]CouponVersion, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT v.id, v.coupon_code, v.version, v.effective_from, v.definition
+                                         FROM coupon_versions v
+                                         JOIN coupons c ON c.coupon_code = v.coupon_code
+                                         WHERE c.normalized_code = $1 ORDER BY v.version`, NormalizeCode(couponCode))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []CouponVersion
+	var previous map[string]interface{}
+	for rows.Next() {
+		var v CouponVersion
+		var definition []byte
+		if err := rows.Scan(&v.ID, &v.CouponCode, &v.Version, &v.EffectiveFrom, &definition); err != nil {
+			return nil, err
+		}
+		v.Definition = definition
+
+		var current map[string]interface{}
+		if err := json.Unmarshal(definition, &current); err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			v.Changes = diffDefinitions(previous, current)
+		}
+		previous = current
+
+		versions = append(versions, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func diffDefinitions(from, to map[string]interface{}) []FieldChange {
+	fields := map[string]bool{}
+	for k := range from {
+		fields[k] = true
+	}
+	for k := range to {
+		fields[k] = true
+	}
+
+	var names []string
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var changes []FieldChange
+	for _, k := range names {
+		if !reflect.DeepEqual(from[k], to[k]) {
+			changes = append(changes, FieldChange{Field: k, From: from[k], To: to[k]})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Siddheshk02/coupon-system/internal/rules"
+)
+
+// Sales channels a coupon can be restricted to.
+const (
+	ChannelApp = "app"
+	ChannelWeb = "web"
+	ChannelPOS = "pos"
+)
+
+// Reasons a coupon is rejected for a cart.
+const (
+	ReasonNotFound        = "coupon not found"
+	ReasonExpired         = "coupon expired"
+	ReasonMinOrderValue   = "cart value below the coupon minimum"
+	ReasonCategory        = "coupon does not apply to any item in the cart"
+	ReasonPaymentMethod   = "coupon not valid for the selected payment method"
+	ReasonChannel         = "coupon not valid on this sales channel"
+	ReasonAppVersion      = "app version too old for this coupon"
+	ReasonRegion          = "coupon not available in the delivery region"
+	ReasonRule            = "coupon eligibility conditions not met"
+	ReasonAlreadyUsed     = "coupon already used"
+	ReasonNotIssuedToUser = "coupon not issued to this user"
+	ReasonLinkedAccounts  = "coupon already redeemed by a linked account"
+	ReasonOutOfStock      = "cart contains items that are out of stock"
+)
+
+func IsValidChannel(channel string) bool {
+	return channel == ChannelApp || channel == ChannelWeb || channel == ChannelPOS
+}
+
+// checkEligibility evaluates the coupon restrictions that depend only on the
+// request, returning the rejection reason or "" if the coupon applies.
+func checkEligibility(coupon Coupon, couponReq CouponRequest) string {
+	if !isApplicableToCart(coupon, couponReq.CartItems) {
+		return ReasonCategory
+	}
+
+	if len(coupon.PaymentMethods) > 0 && !containsStringFold(coupon.PaymentMethods, couponReq.PaymentMethod) {
+		return ReasonPaymentMethod
+	}
+
+	if len(coupon.Channels) > 0 && !containsStringFold(coupon.Channels, couponReq.Channel) {
+		return ReasonChannel
+	}
+
+	// The app version is only known for requests coming from the app
+	if coupon.MinAppVersion != "" && strings.EqualFold(couponReq.Channel, ChannelApp) {
+		if couponReq.AppVersion == "" || compareVersions(couponReq.AppVersion, coupon.MinAppVersion) < 0 {
+			return ReasonAppVersion
+		}
+	}
+
+	if !coupon.Region.IsEmpty() && !coupon.Region.Allows(couponReq.DeliveryRegion) {
+		return ReasonRegion
+	}
+
+	return ""
+}
+
+func (reg Region) IsEmpty() bool {
+	return len(reg.Pincodes) == 0 && len(reg.Cities) == 0 && len(reg.States) == 0
+}
+
+// Allows reports whether the delivery region is covered by the targeting.
+// Region-targeted coupons need a known delivery region either way.
+func (reg Region) Allows(region *DeliveryRegion) bool {
+	if region == nil {
+		return false
+	}
+
+	match := containsStringFold(reg.Pincodes, strings.TrimSpace(region.Pincode)) ||
+		containsStringFold(reg.Cities, strings.TrimSpace(region.City)) ||
+		containsStringFold(reg.States, strings.TrimSpace(region.State))
+
+	return match != reg.Exclude
+}
+
+func isApplicableToCart(coupon Coupon, cartItems []CartItem) bool {
+	for _, item := range cartItems {
+		for _, category := range coupon.ApplicableCategories {
+			if categoryCovers(category, item.Category) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsStringFold(slice []string, str string) bool {
+	for _, s := range slice {
+		if strings.EqualFold(strings.TrimSpace(s), str) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareVersions compares dotted version strings such as "4.12.1"
+// numerically, treating missing or non-numeric parts as zero.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Redeemer is what the validation path knows about the user redeeming a
+// coupon.
+type Redeemer struct {
+	UserID         int `json:"user_id"`
+	OrderCount     int `json:"order_count"` // not counting cancelled orders
+	AccountAgeDays int `json:"account_age_days"`
+	CouponUses     int `json:"coupon_uses"` // prior redemptions of the coupon being checked
+}
+
+// evaluateCoupon runs every check that needs no database access and returns
+// the rejection reason, or "" if the coupon applies. A nil user skips the
+// checks that depend on who is redeeming.
+func evaluateCoupon(coupon Coupon, couponReq CouponRequest, user *Redeemer) string {
+	if !coupon.ExpiryDate.After(requestTime(couponReq)) {
+		return ReasonExpired
+	}
+
+	if cartSubtotal(couponReq) < coupon.MinOrderValue {
+		return ReasonMinOrderValue
+	}
+
+	if reason := checkEligibility(coupon, couponReq); reason != "" {
+		return reason
+	}
+
+	if reason := checkRule(coupon, couponReq, user); reason != "" {
+		return reason
+	}
+
+	// Check if the coupon is a one-time usage or multi-use usage type
+	if user != nil && coupon.UsageType == UsageOneTime && user.CouponUses >= 1 {
+		return ReasonAlreadyUsed
+	}
+
+	return ""
+}
+
+// checkRule evaluates the coupon's eligibility rule, if any. Without a user,
+// rules that read user data are skipped rather than failed.
+func checkRule(coupon Coupon, couponReq CouponRequest, user *Redeemer) string {
+	if coupon.EligibilityRule == "" {
+		return ""
+	}
+
+	program, err := rules.Cached(coupon.EligibilityRule)
+	if err != nil {
+		return ReasonRule
+	}
+
+	env := ruleEnv(couponReq)
+	if program.References("user") {
+		if user == nil {
+			return ""
+		}
+		env.User = rules.User{ID: user.UserID, OrderCount: user.OrderCount, AccountAgeDays: user.AccountAgeDays}
+	}
+
+	ok, err := program.Eval(env)
+	if err != nil || !ok {
+		return ReasonRule
+	}
+	return ""
+}
+
+func ruleEnv(couponReq CouponRequest) rules.Env {
+	var env rules.Env
+
+	env.Cart.Total = couponReq.OrderTotal
+	env.Cart.Subtotal = cartSubtotal(couponReq)
+	for _, item := range couponReq.CartItems {
+		env.Cart.Items = append(env.Cart.Items, rules.Item{ID: item.ID, Name: item.Name, Category: item.Category, Price: item.Price})
+	}
+
+	env.Context.Channel = couponReq.Channel
+	env.Context.PaymentMethod = couponReq.PaymentMethod
+	env.Context.AppVersion = couponReq.AppVersion
+	if couponReq.DeliveryRegion != nil {
+		env.Context.Pincode = couponReq.DeliveryRegion.Pincode
+		env.Context.City = couponReq.DeliveryRegion.City
+		env.Context.State = couponReq.DeliveryRegion.State
+	}
+
+	at := requestTime(couponReq)
+	env.Context.Hour = at.Hour()
+	env.Context.Weekday = int(at.Weekday())
+
+	return env
+}
+
+func cartSubtotal(couponReq CouponRequest) float64 {
+	var total float64
+	for _, item := range couponReq.CartItems {
+		total += item.Price
+	}
+	return total
+}
+
+var timestampLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+var ErrInvalidTimestamp = errors.New("timestamp must be RFC 3339, e.g. 2025-05-05T15:00:00Z")
+
+// ParseTimestamp parses a request timestamp. It returns ErrInvalidTimestamp
+// if the timestamp is in none of the accepted layouts.
+func ParseTimestamp(s string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if at, err := time.Parse(layout, s); err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, ErrInvalidTimestamp
+}
+
+// requestTime returns the time of the request, or the current time if it
+// has no timestamp. Handlers reject timestamps that do not parse.
+func requestTime(couponReq CouponRequest) time.Time {
+	if at, err := ParseTimestamp(couponReq.Timestamp); err == nil {
+		return at
+	}
+	return time.Now()
+}
+
+// loadRedeemer looks up the user's order history. Cancelled orders do not
+// count, so a first-order coupon stays usable after cancelling the first
+// order. Unknown users are treated as having no orders.
+func (r *CouponRepository) loadRedeemer(ctx context.Context, q queryRower, couponCode string, userID int) (Redeemer, error) {
+	query := `SELECT u.id, u.created_at,
+                     (SELECT COUNT(*) FROM orders o WHERE o.user_id = u.id AND o.order_status <> 'cancelled'),
+                     (SELECT COUNT(*) FROM order_coupons oc JOIN orders o ON o.id = oc.order_id
+                      WHERE o.user_id = u.id AND oc.coupon_code = $2 AND oc.released_at IS NULL)
+              FROM users u WHERE u.id = $1`
+
+	var user Redeemer
+	var createdAt time.Time
+	err := q.QueryRowContext(ctx, query, userID, couponCode).Scan(&user.UserID, &createdAt, &user.OrderCount, &user.CouponUses)
+	if err == sql.ErrNoRows {
+		return user, nil
+	} else if err != nil {
+		return user, err
+	}
+
+	user.AccountAgeDays = int(time.Since(createdAt).Hours() / 24)
+	return user, nil
+}
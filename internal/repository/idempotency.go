@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// MaxIdempotencyKeyLength is the longest Idempotency-Key accepted.
+const MaxIdempotencyKeyLength = 255
+
+// idempotencyLockTimeout is how long a request may hold its key before a
+// retry is allowed to take over, for requests that never completed.
+const idempotencyLockTimeout = time.Minute
+
+var (
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used with a different request")
+	ErrRequestInProgress    = errors.New("a request with this idempotency key is in progress")
+)
+
+// StoredResponse is the response recorded for an idempotency key.
+type StoredResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+type IdempotencyRepository struct {
+	DB        *sql.DB
+	Retention time.Duration // how long responses are replayed
+}
+
+func NewIdempotencyRepository(db *sql.DB, retention time.Duration) *IdempotencyRepository {
+	return &IdempotencyRepository{DB: db, Retention: retention}
+}
+
+// Begin claims the key for a request with the given hash. It returns nil if
+// the caller now holds the key and must Complete or Release it, or the
+// stored response if the same request already completed. It returns
+// ErrIdempotencyKeyReused if the key was used with a different request and
+// ErrRequestInProgress if the first request has not finished yet.
+func (i *IdempotencyRepository) Begin(ctx context.Context, scope, key, requestHash string) (*StoredResponse, error) {
+	now := time.Now()
+
+	// Expired keys are taken over as if they were new. Keys held by requests
+	// that never completed are only taken over by a retry of the same
+	// request, which the handler must check against what the first one may
+	// have done before it stopped.
+	query := `INSERT INTO idempotency_keys (scope, key, request_hash, created_at) VALUES ($1, $2, $3, $4)
+              ON CONFLICT (scope, key) DO UPDATE SET
+                  request_hash = EXCLUDED.request_hash, status_code = NULL, content_type = NULL, response = NULL, created_at = EXCLUDED.created_at
+              WHERE idempotency_keys.created_at < $5
+                 OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < $6
+                     AND idempotency_keys.request_hash = EXCLUDED.request_hash)
+              RETURNING key`
+
+	var claimed string
+	err := i.DB.QueryRowContext(ctx, query, scope, key, requestHash, now,
+		now.Add(-i.Retention), now.Add(-idempotencyLockTimeout)).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var hash string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err = i.DB.QueryRowContext(ctx, `SELECT request_hash, status_code, content_type, response FROM idempotency_keys WHERE scope = $1 AND key = $2`,
+		scope, key).Scan(&hash, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// Released between the two statements; the client may retry
+		return nil, ErrRequestInProgress
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case hash != requestHash:
+		return nil, ErrIdempotencyKeyReused
+	case !status.Valid:
+		return nil, ErrRequestInProgress
+	}
+	return &StoredResponse{StatusCode: int(status.Int64), ContentType: contentType.String, Body: body}, nil
+}
+
+// Complete stores the response to replay for the key.
+func (i *IdempotencyRepository) Complete(ctx context.Context, scope, key string, resp StoredResponse) error {
+	_, err := i.DB.ExecContext(ctx, `UPDATE idempotency_keys SET status_code = $3, content_type = $4, response = $5
+                                        WHERE scope = $1 AND key = $2 AND status_code IS NULL`,
+		scope, key, resp.StatusCode, resp.ContentType, resp.Body)
+	return err
+}
+
+// Release gives up the key without a response, so that a retry runs the
+// request again.
+func (i *IdempotencyRepository) Release(ctx context.Context, scope, key string) error {
+	_, err := i.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status_code IS NULL`, scope, key)
+	return err
+}
+
+// Prune deletes keys created before the given time.
+func (i *IdempotencyRepository) Prune(ctx context.Context, before time.Time) error {
+	_, err := i.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, before)
+	return err
+}
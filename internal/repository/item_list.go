@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes for item listings.
+const (
+	DefaultItemPageSize = 50
+	MaxItemPageSize     = 200
+)
+
+var ErrInvalidSort = errors.New("unknown sort: must be id, name or price, optionally prefixed with -")
+
+// ItemFilter narrows an item listing. Zero values match every item that has
+// not been deleted.
+type ItemFilter struct {
+	ID         int
+	Category   string // path; includes the category's subcategories
+	CategoryID int    // includes the category's subcategories
+	Search     string // part of the name, ignoring case
+	MinPrice   *float64
+	MaxPrice   *float64
+	Sort       string // id, name or price; prefixed with - for descending
+	Limit      int
+	Cursor     string // next_cursor of the previous page
+}
+
+type itemSort struct {
+	expr string // sort key
+	cast string // type of the key in the cursor
+}
+
+var itemSorts = map[string]itemSort{
+	"id":    {expr: "id", cast: "int"},
+	"name":  {expr: "COALESCE(name, '')", cast: "text"},
+	"price": {expr: "price", cast: "numeric"},
+}
+
+// The cursor records the sort it was made for, so it cannot be replayed
+// against a different ordering.
+func encodeItemCursor(sort, key, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sort + "|" + id + "|" + key))
+}
+
+func decodeItemCursor(s, sort string) (key string, id int, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 || parts[0] != sort {
+		return "", 0, ErrInvalidCursor
+	}
+	if id, err = strconv.Atoi(parts[1]); err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	return parts[2], id, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// GetItems returns one page of catalog items matching the filter. The
+// returned cursor fetches the next page and is empty on the last one. It
+// returns ErrInvalidSort, or ErrInvalidCursor if the cursor cannot be decoded
+// or was made for a different sort.
+func (i *ItemRepository) GetItems(ctx context.Context, f ItemFilter) ([]Item, string, error) {
+	if f.Sort == "" {
+		f.Sort = "id"
+	}
+	desc := strings.HasPrefix(f.Sort, "-")
+	sort, ok := itemSorts[strings.TrimPrefix(f.Sort, "-")]
+	if !ok {
+		return nil, "", ErrInvalidSort
+	}
+
+	if f.Limit <= 0 {
+		f.Limit = DefaultItemPageSize
+	} else if f.Limit > MaxItemPageSize {
+		f.Limit = MaxItemPageSize
+	}
+
+	var after *string
+	var afterID int
+	if f.Cursor != "" {
+		key, id, err := decodeItemCursor(f.Cursor, f.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+		after, afterID = &key, id
+	}
+
+	dir, cmp := "ASC", ">"
+	if desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	query := `SELECT ` + itemColumns + `, ` + sort.expr + `::text FROM items
+              WHERE deleted_at IS NULL
+                AND ($2 = 0 OR id = $2)
+                AND ($3 = '' OR category_id IN ` + categorySubtree("LOWER(path) = LOWER($3)") + `)
+                AND ($10 = 0 OR category_id IN ` + categorySubtree("id = $10") + `)
+                AND ($4 = '' OR name ILIKE '%' || $4 || '%')
+                AND ($5::numeric IS NULL OR price >= $5)
+                AND ($6::numeric IS NULL OR price <= $6)
+                AND ($7::text IS NULL OR (` + sort.expr + `, id) ` + cmp + ` ($7::text::` + sort.cast + `, $8))
+              ORDER BY ` + sort.expr + ` ` + dir + `, id ` + dir + `
+              LIMIT $9`
+
+	// One extra row tells whether there is a next page
+	rows, err := i.DB.QueryContext(ctx, query, time.Now(), f.ID, NormalizeCategoryPath(f.Category), likeEscaper.Replace(f.Search),
+		f.MinPrice, f.MaxPrice, after, afterID, f.Limit+1, f.CategoryID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	var keys []string
+	for rows.Next() {
+		var item Item
+		var key string
+		if err := rows.Scan(&item.ID, &item.Name, &item.Category, &item.CategoryID, &item.Price, &item.Stock, &item.Available, &key); err != nil {
+			return nil, "", err
+		}
+		item.InStock = item.Available == nil || *item.Available > 0
+		items = append(items, item)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(items) > f.Limit {
+		items = items[:f.Limit]
+		next = encodeItemCursor(f.Sort, keys[f.Limit-1], items[f.Limit-1].ID)
+	}
+	return items, next, nil
+}
@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+)
+
+func TestItemCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		sort, key string
+		id        int
+	}{
+		{"id", "17", 17},
+		{"price", "99.50", 3},
+		// Names may contain the separator
+		{"-name", "Cough | Cold", 8},
+		{"name", "", 9},
+	}
+
+	for _, tt := range tests {
+		key, id, err := decodeItemCursor(encodeItemCursor(tt.sort, tt.key, strconv.Itoa(tt.id)), tt.sort)
+		if err != nil {
+			t.Errorf("%s cursor: %v", tt.sort, err)
+			continue
+		}
+		if key != tt.key || id != tt.id {
+			t.Errorf("%s cursor = (%q, %d), want (%q, %d)", tt.sort, key, id, tt.key, tt.id)
+		}
+	}
+}
+
+func TestDecodeItemCursorErrors(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		cursor, sort string
+	}{
+		{"not base64!", "id"},
+		{encode("id|17"), "id"},
+		{encode("id|x|17"), "id"},
+		// A cursor only works for the sort it was made for
+		{encodeItemCursor("price", "9.99", "3"), "-price"},
+	}
+	for _, tt := range tests {
+		if _, _, err := decodeItemCursor(tt.cursor, tt.sort); err != ErrInvalidCursor {
+			t.Errorf("decodeItemCursor(%q, %q) error = %v, want ErrInvalidCursor", tt.cursor, tt.sort, err)
+		}
+	}
+}
@@ -3,50 +3,131 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
 )
 
 type Item struct {
-	ID       string  `json:"id"`
-	Name     string  `json:"name"`
-	Category string  `json:"category"`
-	Price    float64 `json:"price"`
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Category   string  `json:"category"` // path of the category
+	CategoryID int     `json:"category_id"`
+	Price      float64 `json:"price"`
+	Stock      *int    `json:"stock"` // nil if stock is not tracked
+
+	// Available is the stock not held by reservations; nil if stock is not
+	// tracked
+	Available *int `json:"available"`
+	InStock   bool `json:"in_stock"`
+}
+
+// ItemPatch holds the fields to change on an item; nil fields are kept. The
+// category may be given by id or path.
+type ItemPatch struct {
+	Name       *string  `json:"name"`
+	Category   *string  `json:"category"`
+	CategoryID *int     `json:"category_id"`
+	Price      *float64 `json:"price"`
 }
 
 type ItemRepository struct {
-	DB *sql.DB
+	DB             *sql.DB
+	ReservationTTL time.Duration // how long a checkout holds stock
 }
 
-func NewItemRepository(db *sql.DB) *ItemRepository {
-	return &ItemRepository{DB: db}
+func NewItemRepository(db *sql.DB, reservationTTL time.Duration) *ItemRepository {
+	return &ItemRepository{DB: db, ReservationTTL: reservationTTL}
 }
 
+// CreateItem adds an item to the catalog in the category given by
+// CategoryID, or by the Category path if it is 0. It returns
+// ErrUnknownCategory if the category does not exist.
 func (i *ItemRepository) CreateItem(ctx context.Context, req Item) error {
-	query := `INSERT INTO items (name, category, price) 
-              VALUES ($1, $2, $3)`
-	_, err := i.DB.ExecContext(ctx, query, req.Name, req.Category, req.Price)
+	categoryID, category, err := resolveCategory(ctx, i.DB, req.CategoryID, req.Category)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO items (name, category, category_id, price, stock)
+              VALUES ($1, $2, $3, $4, $5)`
+	_, err = i.DB.ExecContext(ctx, query, req.Name, category, categoryID, req.Price, req.Stock)
 	return err
 }
 
-func (i *ItemRepository) GetItems(ctx context.Context, id int, category string) ([]Item, error) {
-	rows, err := i.DB.QueryContext(ctx, `SELECT id, name, category, price FROM items WHERE ($1 = 0 OR id = $1) and ($2 = '' OR category = $2) ORDER BY id`, id, category)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+// itemColumns selects an item with its availability; $1 must be the current
+// time.
+var itemColumns = `id, COALESCE(name, ''), category, category_id, price, stock, GREATEST(stock - ` + reservedByOthers("0", "$1") + `, 0)`
 
-	var items []Item
-	for rows.Next() {
-		var item Item
-		if err := rows.Scan(&item.ID, &item.Name, &item.Category, &item.Price); err != nil {
-			return nil, err
-		}
+func scanItem(row rowScanner) (Item, error) {
+	var item Item
+	err := row.Scan(&item.ID, &item.Name, &item.Category, &item.CategoryID, &item.Price, &item.Stock, &item.Available)
+	item.InStock = item.Available == nil || *item.Available > 0
+	return item, err
+}
 
-		items = append(items, item)
+// GetItem returns the item, or sql.ErrNoRows if it does not exist or was
+// deleted.
+func (i *ItemRepository) GetItem(ctx context.Context, id int) (Item, error) {
+	query := `SELECT ` + itemColumns + ` FROM items WHERE id = $2 AND deleted_at IS NULL`
+	return scanItem(i.DB.QueryRowContext(ctx, query, time.Now(), id))
+}
+
+// UpdateItem replaces the item's name, category and price. Stock is set with
+// SetStock. It returns sql.ErrNoRows if the item does not exist or was
+// deleted, or ErrUnknownCategory.
+func (i *ItemRepository) UpdateItem(ctx context.Context, id int, req Item) (Item, error) {
+	return i.PatchItem(ctx, id, ItemPatch{Name: &req.Name, Category: &req.Category, CategoryID: &req.CategoryID, Price: &req.Price})
+}
+
+// PatchItem changes the given fields of the item. It returns sql.ErrNoRows if
+// the item does not exist or was deleted, or ErrUnknownCategory.
+func (i *ItemRepository) PatchItem(ctx context.Context, id int, patch ItemPatch) (Item, error) {
+	var categoryID *int
+	var category *string
+	if (patch.CategoryID != nil && *patch.CategoryID != 0) || patch.Category != nil {
+		var byID int
+		var byPath string
+		if patch.CategoryID != nil {
+			byID = *patch.CategoryID
+		}
+		if patch.Category != nil {
+			byPath = *patch.Category
+		}
+		resolvedID, path, err := resolveCategory(ctx, i.DB, byID, byPath)
+		if err != nil {
+			return Item{}, err
+		}
+		categoryID, category = &resolvedID, &path
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	query := `UPDATE items SET name = COALESCE($2, name), category = COALESCE($3, category),
+                  category_id = COALESCE($4, category_id), price = COALESCE($5, price)
+              WHERE id = $1 AND deleted_at IS NULL`
+
+	res, err := i.DB.ExecContext(ctx, query, id, patch.Name, category, categoryID, patch.Price)
+	if err != nil {
+		return Item{}, err
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Item{}, err
+	} else if n == 0 {
+		return Item{}, sql.ErrNoRows
+	}
+
+	return i.GetItem(ctx, id)
+}
 
-	return items, nil
+// DeleteItem hides the item from the catalog and stops it being ordered or
+// reserved. Past orders keep their copy of it. It returns sql.ErrNoRows if
+// the item does not exist or was already deleted.
+func (i *ItemRepository) DeleteItem(ctx context.Context, id int) error {
+	res, err := i.DB.ExecContext(ctx, `UPDATE items SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`, id, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
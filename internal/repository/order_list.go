@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes for order listings.
+const (
+	DefaultOrderPageSize = 20
+	MaxOrderPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// OrderFilter narrows an order listing. Zero values match every order.
+type OrderFilter struct {
+	UserID     int
+	Status     string
+	CouponCode string // in any form
+	From       *time.Time
+	To         *time.Time // exclusive
+	MinAmount  *float64   // on amount_paid
+	MaxAmount  *float64
+	Limit      int
+	Cursor     string // next_cursor of the previous page
+}
+
+type orderCursor struct {
+	orderedAt time.Time
+	id        int
+}
+
+func encodeOrderCursor(c orderCursor) string {
+	raw := c.orderedAt.Format(time.RFC3339Nano) + "|" + strconv.Itoa(c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeOrderCursor(s string) (orderCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return orderCursor{}, ErrInvalidCursor
+	}
+	at, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return orderCursor{}, ErrInvalidCursor
+	}
+
+	var c orderCursor
+	if c.orderedAt, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return orderCursor{}, ErrInvalidCursor
+	}
+	if c.id, err = strconv.Atoi(id); err != nil {
+		return orderCursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// ListOrders returns one page of orders matching the filter, newest first,
+// with their line items. The returned cursor fetches the next page and is
+// empty on the last one. It returns ErrInvalidCursor if the cursor cannot be
+// decoded.
+func (o *OrderRepository) ListOrders(ctx context.Context, f OrderFilter) ([]PlacedOrder, string, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultOrderPageSize
+	} else if f.Limit > MaxOrderPageSize {
+		f.Limit = MaxOrderPageSize
+	}
+
+	var after *time.Time
+	var afterID int
+	if f.Cursor != "" {
+		c, err := decodeOrderCursor(f.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after, afterID = &c.orderedAt, c.id
+	}
+
+	query := `SELECT ` + orderColumns + ` FROM orders
+              WHERE ($1 = 0 OR user_id = $1)
+                AND ($2 = '' OR order_status = $2)
+                AND ($3 = '' OR EXISTS (SELECT 1 FROM order_coupons oc JOIN coupons c ON c.coupon_code = oc.coupon_code
+                                        WHERE oc.order_id = orders.id AND c.normalized_code = $3))
+                AND ($4::timestamp IS NULL OR ordered_at >= $4)
+                AND ($5::timestamp IS NULL OR ordered_at < $5)
+                AND ($6::numeric IS NULL OR amount_paid >= $6)
+                AND ($7::numeric IS NULL OR amount_paid <= $7)
+                AND ($8::timestamp IS NULL OR (ordered_at, id) < ($8, $9))
+              ORDER BY ordered_at DESC, id DESC
+              LIMIT $10`
+
+	// One extra row tells whether there is a next page
+	rows, err := o.DB.QueryContext(ctx, query, f.UserID, f.Status, NormalizeCode(f.CouponCode),
+		f.From, f.To, f.MinAmount, f.MaxAmount, after, afterID, f.Limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	orders := []PlacedOrder{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(orders) > f.Limit {
+		orders = orders[:f.Limit]
+		last := orders[len(orders)-1]
+		next = encodeOrderCursor(orderCursor{orderedAt: last.OrderedAt, id: last.ID})
+	}
+
+	if err := o.loadOrderItems(ctx, orders); err != nil {
+		return nil, "", err
+	}
+	if err := o.loadOrderCoupons(ctx, orders); err != nil {
+		return nil, "", err
+	}
+	return orders, next, nil
+}
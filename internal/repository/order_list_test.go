@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestOrderCursorRoundTrip(t *testing.T) {
+	want := orderCursor{
+		orderedAt: time.Date(2025, 3, 4, 5, 6, 7, 123456789, time.UTC),
+		id:        42,
+	}
+
+	got, err := decodeOrderCursor(encodeOrderCursor(want))
+	if err != nil {
+		t.Fatalf("decodeOrderCursor: %v", err)
+	}
+	// Nanoseconds are kept so that orders in the same second are not skipped
+	if !got.orderedAt.Equal(want.orderedAt) || got.id != want.id {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeOrderCursorErrors(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []string{
+		"not base64!",
+		encode("2025-03-04T05:06:07Z"),
+		encode("yesterday|42"),
+		encode("2025-03-04T05:06:07Z|forty-two"),
+	}
+	for _, cursor := range tests {
+		if _, err := decodeOrderCursor(cursor); err != ErrInvalidCursor {
+			t.Errorf("decodeOrderCursor(%q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
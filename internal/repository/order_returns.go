@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+var (
+	ErrNotReturnable = errors.New("only delivered orders can be returned")
+	ErrInvalidReturn = errors.New("returned quantity exceeds the quantity left on the order")
+)
+
+type ReturnedItem struct {
+	ItemID           int     `json:"item_id"`
+	Quantity         int     `json:"quantity"`
+	Amount           float64 `json:"amount"`            // catalog price of the returned units
+	DiscountClawback float64 `json:"discount_clawback"` // the line discount on the returned units
+	Refund           float64 `json:"refund"`
+}
+
+type ReturnResult struct {
+	OrderID int            `json:"order_id"`
+	Items   []ReturnedItem `json:"items"`
+	// MinOrderClawback is the discount left on the kept items by coupons
+	// whose minimum order value they no longer reach, taken back.
+	MinOrderClawback float64 `json:"min_order_clawback"`
+	Refund           float64 `json:"refund"`
+	OrderStatus      string  `json:"order_status"`
+}
+
+type orderItemRow struct {
+	id, itemID, quantity, returned int
+	unitPrice, lineDiscount        float64
+}
+
+// ReturnItems refunds part of a delivered order. Each returned unit is
+// refunded at its price less its share of the line discount. If the items
+// kept no longer reach a coupon's minimum order value, that coupon's share
+// of the discount on them is clawed back from the refund too. Returning everything left on the
+// order returns it in full, refunding what remains of the amount paid and
+// releasing the coupon. Returned units are not put back in stock, as
+// returned medicines cannot be resold. It returns sql.ErrNoRows if the order does not
+// exist, ErrNotReturnable, ErrUnknownItem or ErrInvalidReturn.
+func (o *OrderRepository) ReturnItems(ctx context.Context, orderID int, lines []OrderLine, actor, note string) (ReturnResult, error) {
+	res := ReturnResult{OrderID: orderID}
+
+	tx, err := o.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var itemsDiscount, chargesDiscount, clawedBack, amountPaid, refunded float64
+	err = tx.QueryRowContext(ctx, `SELECT order_status, items_discount, charges_discount, discount_clawback, amount_paid, refunded_amount
+                                   FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&status, &itemsDiscount, &chargesDiscount, &clawedBack, &amountPaid, &refunded)
+	if err != nil {
+		return res, err
+	}
+	if status != OrderDelivered {
+		return res, ErrNotReturnable
+	}
+
+	items, err := lockOrderItems(ctx, tx, orderID)
+	if err != nil {
+		return res, err
+	}
+
+	for _, line := range lines {
+		row, ok := items[line.ItemID]
+		if !ok {
+			return res, ErrUnknownItem
+		}
+		if line.Quantity > row.quantity-row.returned {
+			return res, ErrInvalidReturn
+		}
+		row.returned += line.Quantity
+
+		ret := returnLine(row, line.Quantity, itemsDiscount+chargesDiscount-clawedBack)
+		res.Items = append(res.Items, ret)
+		res.Refund += ret.Refund
+		clawedBack += ret.DiscountClawback
+
+		if _, err := tx.ExecContext(ctx, `UPDATE order_items SET returned_quantity = $2 WHERE id = $1`, row.id, row.returned); err != nil {
+			return res, err
+		}
+	}
+
+	var kept float64
+	for _, row := range items {
+		kept += row.unitPrice * float64(row.quantity-row.returned)
+	}
+
+	if kept == 0 {
+		res.OrderStatus = OrderReturned
+		res.Refund = roundAmount(amountPaid - refunded)
+		if err := setOrderStatus(ctx, tx, orderID, status, OrderReturned, actor, note); err != nil {
+			return res, err
+		}
+		return res, tx.Commit()
+	}
+
+	res.MinOrderClawback, err = clawBackMinOrder(ctx, tx, orderID, kept, itemsDiscount+chargesDiscount-clawedBack)
+	if err != nil {
+		return res, err
+	}
+	clawedBack += res.MinOrderClawback
+	res.Refund -= res.MinOrderClawback
+
+	res.OrderStatus = status
+	res.Refund = roundAmount(math.Min(math.Max(0, res.Refund), amountPaid-refunded))
+
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET refunded_amount = refunded_amount + $2, discount_clawback = $3 WHERE id = $1`,
+		orderID, res.Refund, roundAmount(clawedBack))
+	if err != nil {
+		return res, err
+	}
+
+	return res, tx.Commit()
+}
+
+// lockOrderItems returns the order's line items keyed by item id.
+func lockOrderItems(ctx context.Context, tx *sql.Tx, orderID int) (map[int]*orderItemRow, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, item_id, quantity, returned_quantity, unit_price, line_discount
+                                       FROM order_items WHERE order_id = $1 FOR UPDATE`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := map[int]*orderItemRow{}
+	for rows.Next() {
+		var row orderItemRow
+		if err := rows.Scan(&row.id, &row.itemID, &row.quantity, &row.returned, &row.unitPrice, &row.lineDiscount); err != nil {
+			return nil, err
+		}
+		items[row.itemID] = &row
+	}
+
+	return items, rows.Err()
+}
+
+// returnLine prices the return of qty units of a line. The units' share of
+// the line discount is clawed back, but no more than the discount left on
+// the order, so that discount taken back by an earlier return is not taken
+// twice.
+func returnLine(row *orderItemRow, qty int, left float64) ReturnedItem {
+	ret := ReturnedItem{ItemID: row.itemID, Quantity: qty}
+	ret.Amount = roundAmount(row.unitPrice * float64(qty))
+	ret.DiscountClawback = roundAmount(math.Min(row.lineDiscount*float64(qty)/float64(row.quantity), math.Max(0, left)))
+	ret.Refund = roundAmount(ret.Amount - ret.DiscountClawback)
+	return ret
+}
+
+type orderCouponRow struct {
+	id            int
+	discount      float64 // the coupon's items and charges discount
+	minOrderValue float64
+	clawedBack    bool
+}
+
+// clawBackMinOrder takes back the discount of the coupons whose minimum
+// order value the kept items no longer reach, and returns the amount. left
+// is the discount still on the order. A coupon's discount is only taken back
+// once.
+func clawBackMinOrder(ctx context.Context, tx *sql.Tx, orderID int, kept, left float64) (float64, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, coupon_version_id, items_discount + charges_discount, min_order_clawed_back
+                                       FROM order_coupons WHERE order_id = $1 FOR UPDATE`, orderID)
+	if err != nil {
+		return 0, err
+	}
+
+	var coupons []orderCouponRow
+	var versionIDs []sql.NullInt64
+	for rows.Next() {
+		var c orderCouponRow
+		var versionID sql.NullInt64
+		if err := rows.Scan(&c.id, &versionID, &c.discount, &c.clawedBack); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		coupons = append(coupons, c)
+		versionIDs = append(versionIDs, versionID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i := range coupons {
+		if coupons[i].minOrderValue, err = orderMinOrderValue(ctx, tx, versionIDs[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	clawback, ids := minOrderClawback(coupons, kept, left)
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `UPDATE order_coupons SET min_order_clawed_back = TRUE WHERE id = $1`, id); err != nil {
+			return 0, err
+		}
+	}
+	return clawback, nil
+}
+
+// minOrderClawback returns each failing coupon's share of the discount left
+// on the order, in proportion to its total discount, and the ids of the
+// coupons it takes back.
+func minOrderClawback(coupons []orderCouponRow, kept, left float64) (float64, []int) {
+	var total float64
+	for _, c := range coupons {
+		total += c.discount
+	}
+	left = math.Max(0, left)
+	if total == 0 {
+		return 0, nil
+	}
+
+	var clawback float64
+	var ids []int
+	for _, c := range coupons {
+		if c.clawedBack || kept >= c.minOrderValue {
+			continue
+		}
+		clawback += left * c.discount / total
+		ids = append(ids, c.id)
+	}
+	return roundAmount(math.Min(clawback, left)), ids
+}
+
+// orderMinOrderValue returns the minimum order value of the coupon version
+// a coupon was applied with, or 0 if it had none.
+func orderMinOrderValue(ctx context.Context, tx *sql.Tx, versionID sql.NullInt64) (float64, error) {
+	if !versionID.Valid {
+		return 0, nil
+	}
+
+	var definition []byte
+	if err := tx.QueryRowContext(ctx, `SELECT definition FROM coupon_versions WHERE id = $1`, versionID.Int64).Scan(&definition); err != nil {
+		return 0, err
+	}
+
+	var coupon Coupon
+	if err := json.Unmarshal(definition, &coupon); err != nil {
+		return 0, err
+	}
+	return coupon.MinOrderValue, nil
+}
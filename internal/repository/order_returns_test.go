@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestReturnWithFixedCoupon returns a line of an order placed with a fixed
+// coupon whose minimum order value the kept items no longer reach.
+func TestReturnWithFixedCoupon(t *testing.T) {
+	placed := PlacedOrder{Items: []OrderItem{{ItemID: 1, Quantity: 1, UnitPrice: 300, Total: 300}, {ItemID: 2, Quantity: 2, UnitPrice: 100, Total: 200}}}
+	couponReq := orderCouponRequest(PlaceOrderRequest{}, &placed)
+	coupon := Coupon{CouponCode: "FLAT100", DiscountType: "fixed", DiscountValue: 100, MinOrderValue: 400}
+	placed.Coupons = []OrderCoupon{toOrderCoupon(toAppliedCoupon(coupon, couponReq), false)}
+	applyCoupons(&placed)
+
+	line := placed.Items[1]
+	row := &orderItemRow{itemID: line.ItemID, quantity: line.Quantity, unitPrice: line.UnitPrice, lineDiscount: line.LineDiscount}
+	ret := returnLine(row, 2, placed.ItemsDiscount)
+	want := ReturnedItem{ItemID: 2, Quantity: 2, Amount: 200, DiscountClawback: 40, Refund: 160}
+	if ret != want {
+		t.Fatalf("returnLine = %+v, want %+v", ret, want)
+	}
+
+	left := placed.ItemsDiscount + placed.ChargesDiscount - ret.DiscountClawback
+	c := placed.Coupons[0]
+	coupons := []orderCouponRow{{id: 1, discount: c.ItemsDiscount + c.ChargesDiscount, minOrderValue: coupon.MinOrderValue}}
+	clawback, ids := minOrderClawback(coupons, 300, left)
+	if clawback != 60 || !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("minOrderClawback = (%v, %v), want (60, [1])", clawback, ids)
+	}
+}
+
+func TestReturnLine(t *testing.T) {
+	row := &orderItemRow{itemID: 7, quantity: 4, unitPrice: 25, lineDiscount: 20}
+
+	tests := []struct {
+		name string
+		qty  int
+		left float64
+		want ReturnedItem
+	}{
+		{"share of the line discount", 1, 100, ReturnedItem{ItemID: 7, Quantity: 1, Amount: 25, DiscountClawback: 5, Refund: 20}},
+		{"whole line", 4, 100, ReturnedItem{ItemID: 7, Quantity: 4, Amount: 100, DiscountClawback: 20, Refund: 80}},
+		// Discount already taken back is not taken twice
+		{"little discount left", 2, 3, ReturnedItem{ItemID: 7, Quantity: 2, Amount: 50, DiscountClawback: 3, Refund: 47}},
+		{"no discount left", 2, -1, ReturnedItem{ItemID: 7, Quantity: 2, Amount: 50, Refund: 50}},
+	}
+
+	for _, tt := range tests {
+		if got := returnLine(row, tt.qty, tt.left); got != tt.want {
+			t.Errorf("%s: returnLine = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMinOrderClawback(t *testing.T) {
+	percentage := orderCouponRow{id: 1, discount: 50, minOrderValue: 400}
+	fixed := orderCouponRow{id: 2, discount: 150, minOrderValue: 200}
+	done := orderCouponRow{id: 3, discount: 50, minOrderValue: 400, clawedBack: true}
+
+	tests := []struct {
+		name    string
+		coupons []orderCouponRow
+		kept    float64
+		left    float64
+		want    float64
+		wantIDs []int
+	}{
+		{"minimum still reached", []orderCouponRow{percentage, fixed}, 400, 200, 0, nil},
+		// Shares follow each coupon's whole discount, charges included
+		{"one coupon fails", []orderCouponRow{percentage, fixed}, 300, 100, 25, []int{1}},
+		{"both coupons fail", []orderCouponRow{percentage, fixed}, 100, 100, 100, []int{1, 2}},
+		{"already taken back", []orderCouponRow{done, fixed}, 300, 100, 0, nil},
+		{"no discount", []orderCouponRow{{id: 4, minOrderValue: 400}}, 100, 0, 0, nil},
+	}
+
+	for _, tt := range tests {
+		got, ids := minOrderClawback(tt.coupons, tt.kept, tt.left)
+		if got != tt.want || !reflect.DeepEqual(ids, tt.wantIDs) {
+			t.Errorf("%s: minOrderClawback = (%v, %v), want (%v, %v)", tt.name, got, ids, tt.want, tt.wantIDs)
+		}
+	}
+}
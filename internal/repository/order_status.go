@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// Order statuses. Orders start pending and move forward one step at a
+// time; they can be cancelled until they ship and returned once shipped.
+// Delivered orders can also be returned in part, see ReturnItems.
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderPacked    = "packed"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderReturned  = "returned"
+)
+
+// orderTransitions lists the statuses each order status can move to.
+var orderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderPacked, OrderCancelled},
+	OrderPacked:    {OrderShipped, OrderCancelled},
+	OrderShipped:   {OrderDelivered, OrderReturned},
+	OrderDelivered: {OrderReturned},
+}
+
+func IsValidOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok || status == OrderCancelled || status == OrderReturned
+}
+
+type OrderStatusChange struct {
+	OrderID    int       `json:"order_id"`
+	FromStatus string    `json:"from_status,omitempty"` // empty when the order was created
+	ToStatus   string    `json:"to_status"`
+	Actor      string    `json:"actor"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TransitionOrder moves the order to a new status on behalf of actor. It
+// returns sql.ErrNoRows if the order does not exist and ErrInvalidTransition
+// if the order cannot move to that status.
+func (o *OrderRepository) TransitionOrder(ctx context.Context, id int, to, actor, note string) error {
+	tx, err := o.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	if err := tx.QueryRowContext(ctx, `SELECT order_status FROM orders WHERE id = $1 FOR UPDATE`, id).Scan(&from); err != nil {
+		return err
+	}
+
+	if !canTransitionOrder(from, to) {
+		return ErrInvalidTransition
+	}
+
+	if err := setOrderStatus(ctx, tx, id, from, to, actor, note); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// canTransitionOrder reports whether an order can move from one status to
+// another.
+func canTransitionOrder(from, to string) bool {
+	return containsString(orderTransitions[from], to)
+}
+
+// setOrderStatus records the status change. Cancelled and returned orders
+// are refunded in full and release their coupon. Only cancelled orders go
+// back in stock; returned goods are deliberately not resold.
+func setOrderStatus(ctx context.Context, tx execer, id int, from, to, actor, note string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET order_status = $2 WHERE id = $1`, id, to); err != nil {
+		return err
+	}
+
+	switch to {
+	case OrderCancelled, OrderReturned:
+		// Pending orders have not been paid for
+		if from != OrderPending {
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET refunded_amount = amount_paid WHERE id = $1`, id); err != nil {
+				return err
+			}
+		}
+		if to == OrderReturned {
+			if _, err := tx.ExecContext(ctx, `UPDATE order_items SET returned_quantity = quantity WHERE order_id = $1`, id); err != nil {
+				return err
+			}
+		} else if err := restockOrder(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := releaseCoupon(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+
+	return insertOrderStatusChange(ctx, tx, id, from, to, actor, note)
+}
+
+// releaseCoupon stops the order's coupon uses from counting against the
+// user's limits, except for coupons configured to stay consumed.
+func releaseCoupon(ctx context.Context, tx execer, orderID int) error {
+	query := `UPDATE order_coupons oc SET released_at = $2
+              FROM coupons c
+              WHERE oc.order_id = $1 AND c.coupon_code = oc.coupon_code
+                AND NOT c.consume_on_cancel AND oc.released_at IS NULL`
+	_, err := tx.ExecContext(ctx, query, orderID, time.Now())
+	return err
+}
+
+func insertOrderStatusChange(ctx context.Context, tx execer, orderID int, from, to, actor, note string) error {
+	query := `INSERT INTO order_status_history (order_id, from_status, to_status, actor, note, created_at)
+              VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), $6)`
+	_, err := tx.ExecContext(ctx, query, orderID, from, to, actor, note, time.Now())
+	return err
+}
+
+func (o *OrderRepository) GetOrderStatusHistory(ctx context.Context, id int) ([]OrderStatusChange, error) {
+	rows, err := o.DB.QueryContext(ctx, `SELECT order_id, COALESCE(from_status, ''), to_status, actor, COALESCE(note, ''), created_at
+                                         FROM order_status_history WHERE order_id = $1 ORDER BY created_at, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []OrderStatusChange
+	for rows.Next() {
+		var c OrderStatusChange
+		if err := rows.Scan(&c.OrderID, &c.FromStatus, &c.ToStatus, &c.Actor, &c.Note, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestIsValidOrderStatus(t *testing.T) {
+	for _, status := range []string{OrderPending, OrderPaid, OrderPacked, OrderShipped, OrderDelivered, OrderCancelled, OrderReturned} {
+		if !IsValidOrderStatus(status) {
+			t.Errorf("IsValidOrderStatus(%q) = false, want true", status)
+		}
+	}
+	for _, status := range []string{"", "Pending", "refunded"} {
+		if IsValidOrderStatus(status) {
+			t.Errorf("IsValidOrderStatus(%q) = true, want false", status)
+		}
+	}
+}
+
+func TestCanTransitionOrder(t *testing.T) {
+	allowed := [][2]string{
+		{OrderPending, OrderPaid},
+		{OrderPending, OrderCancelled},
+		{OrderPacked, OrderCancelled},
+		{OrderShipped, OrderReturned},
+		{OrderDelivered, OrderReturned},
+	}
+	for _, tt := range allowed {
+		if !canTransitionOrder(tt[0], tt[1]) {
+			t.Errorf("canTransitionOrder(%q, %q) = false, want true", tt[0], tt[1])
+		}
+	}
+
+	rejected := [][2]string{
+		{OrderPending, OrderShipped},   // skips a step
+		{OrderPacked, OrderPaid},       // goes back
+		{OrderShipped, OrderCancelled}, // too late to cancel
+		{OrderDelivered, OrderCancelled},
+		{OrderPending, OrderReturned}, // never shipped
+		{OrderCancelled, OrderPaid},   // final
+		{OrderReturned, OrderDelivered},
+		{OrderPaid, OrderPaid},
+		{"unknown", OrderPaid},
+	}
+	for _, tt := range rejected {
+		if canTransitionOrder(tt[0], tt[1]) {
+			t.Errorf("canTransitionOrder(%q, %q) = true, want false", tt[0], tt[1])
+		}
+	}
+}
+
+// recordingExecer records the statements run against it.
+type recordingExecer struct {
+	queries []string
+}
+
+func (r *recordingExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (r *recordingExecer) ran(statement string) bool {
+	for _, q := range r.queries {
+		if strings.HasPrefix(strings.TrimSpace(q), statement) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSetOrderStatusSideEffects(t *testing.T) {
+	const (
+		refund  = "UPDATE orders SET refunded_amount"
+		restock = "UPDATE items SET stock"
+		returns = "UPDATE order_items SET returned_quantity"
+		release = "UPDATE order_coupons oc SET released_at"
+		history = "INSERT INTO order_status_history"
+	)
+
+	tests := []struct {
+		name     string
+		from, to string
+		want     []string
+		wantNot  []string
+	}{
+		{"cancel paid order", OrderPaid, OrderCancelled, []string{refund, restock, release, history}, []string{returns}},
+		// Pending orders have not been paid for
+		{"cancel pending order", OrderPending, OrderCancelled, []string{restock, release, history}, []string{refund, returns}},
+		// Returned goods are not put back in stock
+		{"return order", OrderDelivered, OrderReturned, []string{refund, returns, release, history}, []string{restock}},
+		{"ship order", OrderPacked, OrderShipped, []string{history}, []string{refund, restock, returns, release}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &recordingExecer{}
+			if err := setOrderStatus(context.Background(), tx, 1, tt.from, tt.to, "admin", ""); err != nil {
+				t.Fatalf("setOrderStatus: %v", err)
+			}
+			for _, statement := range tt.want {
+				if !tx.ran(statement) {
+					t.Errorf("%s did not run %q", tt.name, statement)
+				}
+			}
+			for _, statement := range tt.wantNot {
+				if tx.ran(statement) {
+					t.Errorf("%s ran %q", tt.name, statement)
+				}
+			}
+		})
+	}
+}
@@ -3,29 +3,504 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"math"
+	"strconv"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrUnknownUser = errors.New("user does not exist")
+	ErrUnknownItem = errors.New("item does not exist")
+	// ErrOrderAlreadyPlaced is returned with the order already placed for
+	// the request's idempotency key.
+	ErrOrderAlreadyPlaced = errors.New("an order was already placed with this idempotency key")
 )
 
+// CouponRejectedError is returned when the order's coupon cannot be applied.
+type CouponRejectedError struct {
+	Reason string
+}
+
+func (e *CouponRejectedError) Error() string {
+	return "coupon rejected: " + e.Reason
+}
+
 type Order struct {
-	ID             int       `json:"id"`
-	UserID         int       `json:"user_id"`
-	OrderStatus    string    `json:"order_status"`
-	OrderedAt      time.Time `json:"ordered_at"`
-	CouponCodeUsed string    `json:"coupon_code_used"`
-	AmountPaid     float64   `json:"amount_paid"`
+	ID              int       `json:"id"`
+	UserID          int       `json:"user_id"`
+	OrderStatus     string    `json:"order_status"`
+	OrderedAt       time.Time `json:"ordered_at"`
+	CouponCodeUsed  string    `json:"coupon_code_used,omitempty"`
+	Subtotal        float64   `json:"subtotal"`
+	ItemsDiscount   float64   `json:"items_discount"`
+	ChargesDiscount float64   `json:"charges_discount"`
+	AmountPaid      float64   `json:"amount_paid"`
+	RefundedAmount  float64   `json:"refunded_amount"`
+
+	CouponVersionID *int `json:"coupon_version_id,omitempty"` // coupon rules live when the order was placed
+
+	// Coupons lists every coupon applied, the entered one (CouponCodeUsed)
+	// and the automatic promotions applied alongside it
+	Coupons []OrderCoupon `json:"coupons"`
+}
+
+// OrderCoupon is a coupon redeemed by an order. Its use counts against the
+// user's limit until it is released.
+type OrderCoupon struct {
+	CouponCode      string     `json:"coupon_code"`
+	AutoApplied     bool       `json:"auto_applied"`
+	ItemsDiscount   float64    `json:"items_discount"`
+	ChargesDiscount float64    `json:"charges_discount"`
+	CouponVersionID *int       `json:"coupon_version_id,omitempty"`
+	ReleasedAt      *time.Time `json:"released_at,omitempty"`
+}
+
+type OrderLine struct {
+	ItemID   int `json:"item_id"`
+	Quantity int `json:"quantity"`
+}
+
+// PlaceOrderRequest is what a client sends to place an order. Prices and
+// discounts are always computed by the server.
+type PlaceOrderRequest struct {
+	UserID     int         `json:"user_id"`
+	Items      []OrderLine `json:"items"`
+	CouponCode string      `json:"coupon_code,omitempty"`
+
+	PaymentMethod  string          `json:"payment_method,omitempty"`
+	Channel        string          `json:"channel,omitempty"`
+	AppVersion     string          `json:"app_version,omitempty"`
+	DeliveryRegion *DeliveryRegion `json:"delivery_region,omitempty"`
+	Signals        Signals         `json:"signals"`
+
+	IdempotencyKey string `json:"-"` // from the Idempotency-Key header, stored with the order
+}
+
+type OrderItem struct {
+	ItemID       int     `json:"item_id"`
+	Name         string  `json:"name"`
+	Category     string  `json:"category"`
+	Quantity     int     `json:"quantity"`
+	UnitPrice    float64 `json:"unit_price"`
+	Total        float64 `json:"total"`
+	LineDiscount float64 `json:"line_discount"` // share of the order's items discount
+
+	ReturnedQuantity int `json:"returned_quantity"`
+}
+
+// PlacedOrder is an order with its line items.
+type PlacedOrder struct {
+	Order
+	Items []OrderItem `json:"items"`
 }
 
 type OrderRepository struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Coupons *CouponRepository
+
+	// IdempotencyRetention is how long an order is returned again for its
+	// idempotency key, matching how long the key's response is replayed
+	IdempotencyRetention time.Duration
+}
+
+func NewOrderRepository(db *sql.DB, coupons *CouponRepository) *OrderRepository {
+	return &OrderRepository{DB: db, Coupons: coupons}
+}
+
+// PlaceOrder prices the cart from the catalog, applies the entered coupon and
+// the automatic promotions exactly as ValidateCart picks them, and stores the
+// order with a redemption for each coupon. The ordered items are taken out of stock, using up the user's
+// reservation. It returns ErrUnknownUser, ErrUnknownItem, an
+// *OutOfStockError or a *CouponRejectedError if the order cannot be placed.
+// If the user already placed an order with the request's idempotency key,
+// for instance before crashing without storing the response, that order is
+// returned with ErrOrderAlreadyPlaced instead of placing another.
+func (o *OrderRepository) PlaceOrder(ctx context.Context, req PlaceOrderRequest) (PlacedOrder, error) {
+	var placed PlacedOrder
+
+	tx, err := o.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return placed, err
+	}
+	defer tx.Rollback()
+
+	// Orders from the same user are serialized so that usage limits are
+	// checked against every order placed before this one. The lock still
+	// lets the coupon checks insert rows that reference the user.
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR NO KEY UPDATE`, req.UserID).Scan(&placed.UserID)
+	if err == sql.ErrNoRows {
+		return placed, ErrUnknownUser
+	} else if err != nil {
+		return placed, err
+	}
+
+	// The user's lock makes this check see every order placed with the key
+	if req.IdempotencyKey != "" {
+		var id int
+		err := tx.QueryRowContext(ctx, `SELECT id FROM orders WHERE user_id = $1 AND idempotency_key = $2 AND ordered_at > $3`,
+			placed.UserID, req.IdempotencyKey, time.Now().Add(-o.IdempotencyRetention)).Scan(&id)
+		if err == nil {
+			tx.Rollback()
+			existing, err := o.GetOrder(ctx, id)
+			if err != nil {
+				return placed, err
+			}
+			return existing, ErrOrderAlreadyPlaced
+		} else if err != sql.ErrNoRows {
+			return placed, err
+		}
+	}
+
+	placed.Items, err = priceLines(ctx, tx, req.Items)
+	if err != nil {
+		return placed, err
+	}
+
+	couponReq := orderCouponRequest(req, &placed)
+
+	placed.OrderedAt = time.Now()
+	couponReq.Timestamp = placed.OrderedAt.Format(time.RFC3339)
+
+	// Coupons are checked in the order's transaction, before the stock is
+	// taken, which would leave none for the user
+	res, err := o.Coupons.validateCart(ctx, tx, couponReq, placed.UserID)
+	if err != nil {
+		return placed, err
+	}
+
+	if err := takeStock(ctx, tx, placed.UserID, placed.Items, placed.OrderedAt); err != nil {
+		return placed, err
+	}
+
+	var couponCode sql.NullString
+	placed.Coupons = []OrderCoupon{}
+	if req.CouponCode != "" {
+		if res.Entered == nil {
+			if res.Reason == ReasonLinkedAccounts {
+				// No order is placed, but the attempt is queued for review
+				tx.Rollback()
+				if err := o.Coupons.flagBlockedRedemption(ctx, req.CouponCode, placed.UserID, req.Signals); err != nil {
+					return placed, err
+				}
+			}
+			return placed, &CouponRejectedError{Reason: res.Reason}
+		}
+		placed.CouponCodeUsed = res.Entered.CouponCode
+		couponCode = sql.NullString{String: res.Entered.CouponCode, Valid: true}
+		placed.Coupons = append(placed.Coupons, toOrderCoupon(*res.Entered, false))
+	}
+	for _, c := range res.AutoApplied {
+		placed.Coupons = append(placed.Coupons, toOrderCoupon(c, true))
+	}
+	applyCoupons(&placed)
+	placed.OrderStatus = OrderPending
+
+	query := `INSERT INTO orders (user_id, order_status, ordered_at, coupon_code_used, subtotal, items_discount, charges_discount, amount_paid, coupon_version_id, idempotency_key)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8,
+                      (SELECT id FROM coupon_versions WHERE coupon_code = $4 AND effective_from <= $3 ORDER BY version DESC LIMIT 1), NULLIF($9, ''))
+              RETURNING id, coupon_version_id`
+
+	var versionID sql.NullInt64
+	err = tx.QueryRowContext(ctx, query, placed.UserID, placed.OrderStatus, placed.OrderedAt, couponCode,
+		placed.Subtotal, placed.ItemsDiscount, placed.ChargesDiscount, placed.AmountPaid, req.IdempotencyKey).Scan(&placed.ID, &versionID)
+	if err != nil {
+		return placed, err
+	}
+	if versionID.Valid {
+		id := int(versionID.Int64)
+		placed.CouponVersionID = &id
+	}
+
+	if err := insertOrderCoupons(ctx, tx, placed.ID, placed.OrderedAt, placed.Coupons); err != nil {
+		return placed, err
+	}
+	// Signals are only recorded for redemptions that are made
+	for _, c := range placed.Coupons {
+		if err := o.Coupons.recordRedemption(ctx, tx, c.CouponCode, placed.UserID, req.Signals); err != nil {
+			return placed, err
+		}
+	}
+
+	if err := insertOrderItems(ctx, tx, placed.ID, placed.Items); err != nil {
+		return placed, err
+	}
+	// The customer is recorded as the actor that created the order
+	if err := insertOrderStatusChange(ctx, tx, placed.ID, "", placed.OrderStatus, "user:"+strconv.Itoa(placed.UserID), ""); err != nil {
+		return placed, err
+	}
+
+	return placed, tx.Commit()
+}
+
+// orderCouponRequest prices the order's lines into the cart the coupons are
+// checked against, and sets the order's subtotal. Orders carry no charges, so
+// the order total is the subtotal.
+func orderCouponRequest(req PlaceOrderRequest, placed *PlacedOrder) CouponRequest {
+	couponReq := CouponRequest{
+		CouponCode:     req.CouponCode,
+		PaymentMethod:  req.PaymentMethod,
+		Channel:        req.Channel,
+		AppVersion:     req.AppVersion,
+		DeliveryRegion: req.DeliveryRegion,
+		Signals:        req.Signals,
+	}
+	for _, line := range placed.Items {
+		couponReq.CartItems = append(couponReq.CartItems, CartItem{
+			ID:       strconv.Itoa(line.ItemID),
+			Name:     line.Name,
+			Category: line.Category,
+			Price:    line.Total,
+		})
+		placed.Subtotal += line.Total
+	}
+	placed.Subtotal = roundAmount(placed.Subtotal)
+	couponReq.OrderTotal = placed.Subtotal
+	return couponReq
+}
+
+// applyCoupons totals the discounts of the order's coupons and the amount
+// paid. Stacked coupons cannot take off more than the order costs: when they
+// would, each coupon's discount is scaled down in proportion, so the coupons
+// recorded with the order always add up to its discount. The items discount,
+// whichever kind of coupon it came from, is then shared out across the lines.
+func applyCoupons(placed *PlacedOrder) {
+	var total float64
+	for _, c := range placed.Coupons {
+		total += c.ItemsDiscount + c.ChargesDiscount
+	}
+	if total > placed.Subtotal {
+		scale := placed.Subtotal / total
+		for i := range placed.Coupons {
+			placed.Coupons[i].ItemsDiscount = roundAmount(placed.Coupons[i].ItemsDiscount * scale)
+			placed.Coupons[i].ChargesDiscount = roundAmount(placed.Coupons[i].ChargesDiscount * scale)
+		}
+	}
+
+	placed.ItemsDiscount, placed.ChargesDiscount = 0, 0
+	for _, c := range placed.Coupons {
+		placed.ItemsDiscount += c.ItemsDiscount
+		placed.ChargesDiscount += c.ChargesDiscount
+	}
+	placed.ItemsDiscount = roundAmount(placed.ItemsDiscount)
+	placed.ChargesDiscount = roundAmount(placed.ChargesDiscount)
+	placed.AmountPaid = roundAmount(math.Max(0, placed.Subtotal-placed.ItemsDiscount-placed.ChargesDiscount))
+	allocateDiscount(placed.Items, placed.ItemsDiscount)
+}
+
+func toOrderCoupon(c AppliedCoupon, autoApplied bool) OrderCoupon {
+	return OrderCoupon{
+		CouponCode:      c.CouponCode,
+		AutoApplied:     autoApplied,
+		ItemsDiscount:   roundAmount(c.ItemsDiscount),
+		ChargesDiscount: roundAmount(c.ChargesDiscount),
+	}
+}
+
+// insertOrderCoupons records the order's coupons with the versions live when
+// it was placed.
+func insertOrderCoupons(ctx context.Context, tx *sql.Tx, orderID int, orderedAt time.Time, coupons []OrderCoupon) error {
+	query := `INSERT INTO order_coupons (order_id, coupon_code, auto_applied, items_discount, charges_discount, coupon_version_id)
+              VALUES ($1, $2, $3, $4, $5,
+                      (SELECT id FROM coupon_versions WHERE coupon_code = $2 AND effective_from <= $6 ORDER BY version DESC LIMIT 1))
+              RETURNING coupon_version_id`
+
+	for i := range coupons {
+		c := &coupons[i]
+		var versionID sql.NullInt64
+		err := tx.QueryRowContext(ctx, query, orderID, c.CouponCode, c.AutoApplied, c.ItemsDiscount, c.ChargesDiscount, orderedAt).Scan(&versionID)
+		if err != nil {
+			return err
+		}
+		if versionID.Valid {
+			id := int(versionID.Int64)
+			c.CouponVersionID = &id
+		}
+	}
+	return nil
+}
+
+func insertOrderItems(ctx context.Context, tx *sql.Tx, orderID int, items []OrderItem) error {
+	query := `INSERT INTO order_items (order_id, item_id, name, category, quantity, unit_price, line_discount)
+              VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	for _, item := range items {
+		if _, err := tx.ExecContext(ctx, query, orderID, item.ItemID, item.Name, item.Category, item.Quantity, item.UnitPrice, item.LineDiscount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateDiscount splits the items discount across the lines in proportion
+// to their totals. The last line absorbs the rounding so the line discounts
+// add up to the order's.
+func allocateDiscount(items []OrderItem, discount float64) {
+	var total float64
+	for _, item := range items {
+		total += item.Total
+	}
+	if total == 0 || discount == 0 {
+		return
+	}
+
+	remaining := discount
+	for i := range items {
+		share := roundAmount(discount * items[i].Total / total)
+		if i == len(items)-1 {
+			share = roundAmount(remaining)
+		}
+		items[i].LineDiscount = share
+		remaining -= share
+	}
+}
+
+const orderColumns = `id, user_id, order_status, ordered_at, COALESCE(coupon_code_used, ''), subtotal,
+                       items_discount, charges_discount, amount_paid, refunded_amount, coupon_version_id`
+
+func scanOrder(row rowScanner) (PlacedOrder, error) {
+	var order PlacedOrder
+	var versionID sql.NullInt64
+	err := row.Scan(&order.ID, &order.UserID, &order.OrderStatus, &order.OrderedAt, &order.CouponCodeUsed, &order.Subtotal,
+		&order.ItemsDiscount, &order.ChargesDiscount, &order.AmountPaid, &order.RefundedAmount, &versionID)
+	if err != nil {
+		return order, err
+	}
+	if versionID.Valid {
+		v := int(versionID.Int64)
+		order.CouponVersionID = &v
+	}
+	order.Items = []OrderItem{}
+	order.Coupons = []OrderCoupon{}
+	return order, nil
 }
 
-func NewOrderRepository(db *sql.DB) *OrderRepository {
-	return &OrderRepository{DB: db}
+// GetOrder returns the order with its line items, or sql.ErrNoRows.
+func (o *OrderRepository) GetOrder(ctx context.Context, id int) (PlacedOrder, error) {
+	order, err := scanOrder(o.DB.QueryRowContext(ctx, `SELECT `+orderColumns+` FROM orders WHERE id = $1`, id))
+	if err != nil {
+		return order, err
+	}
+
+	orders := []PlacedOrder{order}
+	if err := o.loadOrderItems(ctx, orders); err != nil {
+		return order, err
+	}
+	err = o.loadOrderCoupons(ctx, orders)
+	return orders[0], err
+}
+
+// loadOrderItems fills in the line items of the given orders. Orders placed
+// before line items were recorded have none.
+func (o *OrderRepository) loadOrderItems(ctx context.Context, orders []PlacedOrder) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(orders))
+	index := map[int]int{}
+	for i, order := range orders {
+		ids[i] = int64(order.ID)
+		index[order.ID] = i
+	}
+
+	rows, err := o.DB.QueryContext(ctx, `SELECT order_id, item_id, name, category, quantity, returned_quantity, unit_price, line_discount
+                                         FROM order_items WHERE order_id = ANY($1) ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var item OrderItem
+		if err := rows.Scan(&orderID, &item.ItemID, &item.Name, &item.Category, &item.Quantity, &item.ReturnedQuantity, &item.UnitPrice, &item.LineDiscount); err != nil {
+			return err
+		}
+		item.Total = roundAmount(item.UnitPrice * float64(item.Quantity))
+
+		i := index[orderID]
+		orders[i].Items = append(orders[i].Items, item)
+	}
+
+	return rows.Err()
+}
+
+// loadOrderCoupons fills in the coupons applied to the given orders.
+func (o *OrderRepository) loadOrderCoupons(ctx context.Context, orders []PlacedOrder) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(orders))
+	index := map[int]int{}
+	for i, order := range orders {
+		ids[i] = int64(order.ID)
+		index[order.ID] = i
+	}
+
+	rows, err := o.DB.QueryContext(ctx, `SELECT order_id, coupon_code, auto_applied, items_discount, charges_discount, coupon_version_id, released_at
+                                         FROM order_coupons WHERE order_id = ANY($1) ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var c OrderCoupon
+		var versionID sql.NullInt64
+		var releasedAt sql.NullTime
+		if err := rows.Scan(&orderID, &c.CouponCode, &c.AutoApplied, &c.ItemsDiscount, &c.ChargesDiscount, &versionID, &releasedAt); err != nil {
+			return err
+		}
+		if versionID.Valid {
+			v := int(versionID.Int64)
+			c.CouponVersionID = &v
+		}
+		if releasedAt.Valid {
+			c.ReleasedAt = &releasedAt.Time
+		}
+
+		i := index[orderID]
+		orders[i].Coupons = append(orders[i].Coupons, c)
+	}
+
+	return rows.Err()
+}
+
+// priceLines looks up the catalog price of every line, merging repeated
+// items.
+func priceLines(ctx context.Context, tx *sql.Tx, lines []OrderLine) ([]OrderItem, error) {
+	var priced []OrderItem
+	index := map[int]int{}
+	for _, line := range lines {
+		if i, ok := index[line.ItemID]; ok {
+			priced[i].Quantity += line.Quantity
+			continue
+		}
+
+		p := OrderItem{ItemID: line.ItemID, Quantity: line.Quantity}
+		err := tx.QueryRowContext(ctx, `SELECT COALESCE(name, ''), category, price FROM items WHERE id = $1 AND deleted_at IS NULL`, line.ItemID).Scan(&p.Name, &p.Category, &p.UnitPrice)
+		if err == sql.ErrNoRows {
+			return nil, ErrUnknownItem
+		} else if err != nil {
+			return nil, err
+		}
+
+		index[line.ItemID] = len(priced)
+		priced = append(priced, p)
+	}
+
+	for i := range priced {
+		priced[i].Total = roundAmount(priced[i].UnitPrice * float64(priced[i].Quantity))
+	}
+	return priced, nil
 }
 
-func (o *OrderRepository) CreateOrder(ctx context.Context, req Order) error {
-	query := `INSERT INTO orders (user_id, order_status, ordered_at, coupon_code_used, amount_paid) 
-              VALUES ($1, $2, $3, $4, $5)`
-	_, err := o.DB.ExecContext(ctx, query, req.UserID, req.OrderStatus, req.OrderedAt, req.CouponCodeUsed, req.AmountPaid)
-	return err
+// roundAmount rounds to the two decimal places stored for amounts.
+func roundAmount(v float64) float64 {
+	return math.Round(v*100) / 100
 }
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAllocateDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		totals   []float64
+		discount float64
+		want     []float64
+	}{
+		{"proportional", []float64{300, 100}, 40, []float64{30, 10}},
+		{"single line", []float64{250}, 12.34, []float64{12.34}},
+		// The last line absorbs the rounding
+		{"rounding", []float64{10, 10, 10}, 10, []float64{3.33, 3.33, 3.34}},
+		{"no discount", []float64{100, 50}, 0, []float64{0, 0}},
+		{"free items", []float64{0, 0}, 10, []float64{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := make([]OrderItem, len(tt.totals))
+			for i, total := range tt.totals {
+				items[i].Total = total
+			}
+			allocateDiscount(items, tt.discount)
+
+			var sum float64
+			for i, item := range items {
+				if item.LineDiscount != tt.want[i] {
+					t.Errorf("line %d discount = %v, want %v", i, item.LineDiscount, tt.want[i])
+				}
+				sum += item.LineDiscount
+			}
+			if tt.totals[0] != 0 && math.Abs(sum-tt.discount) > 1e-9 {
+				t.Errorf("line discounts add up to %v, want %v", sum, tt.discount)
+			}
+		})
+	}
+}
+
+// TestPlaceOrderDiscounts follows PlaceOrder from the priced lines to the
+// order's totals.
+func TestPlaceOrderDiscounts(t *testing.T) {
+	lines := []OrderItem{{ItemID: 1, Total: 300}, {ItemID: 2, Total: 200}}
+
+	tests := []struct {
+		name         string
+		coupons      []Coupon
+		wantDiscount []float64 // items discount of each coupon
+		wantPaid     float64
+	}{
+		{"percentage", []Coupon{{CouponCode: "P", DiscountType: "percentage", DiscountValue: 10}}, []float64{50}, 450},
+		{"fixed", []Coupon{{CouponCode: "F", DiscountType: "fixed", DiscountValue: 40}}, []float64{40}, 460},
+		{"fixed above subtotal", []Coupon{{CouponCode: "F", DiscountType: "fixed", DiscountValue: 900}}, []float64{500}, 0},
+		// Stacked coupons are scaled down to the subtotal together
+		{"stacked above subtotal", []Coupon{
+			{CouponCode: "F", DiscountType: "fixed", DiscountValue: 400},
+			{CouponCode: "P", DiscountType: "percentage", DiscountValue: 50},
+		}, []float64{307.69, 192.31}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			placed := PlacedOrder{Items: append([]OrderItem(nil), lines...)}
+			couponReq := orderCouponRequest(PlaceOrderRequest{}, &placed)
+			if placed.Subtotal != 500 || couponReq.OrderTotal != 500 {
+				t.Fatalf("subtotal = %v, order total = %v, want 500", placed.Subtotal, couponReq.OrderTotal)
+			}
+
+			for _, c := range tt.coupons {
+				placed.Coupons = append(placed.Coupons, toOrderCoupon(toAppliedCoupon(c, couponReq), false))
+			}
+			applyCoupons(&placed)
+
+			var sum float64
+			for i, c := range placed.Coupons {
+				if c.ItemsDiscount != tt.wantDiscount[i] || c.ChargesDiscount != 0 {
+					t.Errorf("coupon %s discount = (%v, %v), want (%v, 0)", c.CouponCode, c.ItemsDiscount, c.ChargesDiscount, tt.wantDiscount[i])
+				}
+				sum += c.ItemsDiscount
+			}
+			if placed.ItemsDiscount != roundAmount(sum) || placed.ChargesDiscount != 0 {
+				t.Errorf("order discount = (%v, %v), want (%v, 0)", placed.ItemsDiscount, placed.ChargesDiscount, roundAmount(sum))
+			}
+			if placed.AmountPaid != tt.wantPaid {
+				t.Errorf("amount paid = %v, want %v", placed.AmountPaid, tt.wantPaid)
+			}
+
+			var lineSum float64
+			for _, item := range placed.Items {
+				lineSum += item.LineDiscount
+			}
+			if math.Abs(lineSum-placed.ItemsDiscount) > 1e-9 {
+				t.Errorf("line discounts add up to %v, want %v", lineSum, placed.ItemsDiscount)
+			}
+		})
+	}
+}
+
+func TestRoundAmount(t *testing.T) {
+	tests := map[float64]float64{
+		1.004:  1,
+		1.006:  1.01,
+		2.5:    2.5,
+		-1.236: -1.24,
+		100:    100,
+	}
+	for v, want := range tests {
+		if got := roundAmount(v); got != want {
+			t.Errorf("roundAmount(%v) = %v, want %v", v, got, want)
+		}
+	}
+}
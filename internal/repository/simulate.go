@@ -0,0 +1,49 @@
+package repository
+
+type SimulationRequest struct {
+	Coupon Coupon          `json:"coupon"`
+	Carts  []CouponRequest `json:"carts"`
+	Users  []Redeemer      `json:"users,omitempty"`
+}
+
+type SimulationResult struct {
+	CartIndex       int     `json:"cart_index"`
+	UserID          int     `json:"user_id"`
+	Eligible        bool    `json:"eligible"`
+	Reason          string  `json:"reason,omitempty"`
+	ItemsDiscount   float64 `json:"items_discount"`
+	ChargesDiscount float64 `json:"charges_discount"`
+	TotalDiscount   float64 `json:"total_discount"`
+}
+
+// SimulateCoupon runs the validation and discount logic for an unsaved coupon
+// against every combination of sample cart and user. Nothing is read from or
+// written to the database; without sample users each cart is checked for a
+// new user with no order history.
+func SimulateCoupon(req SimulationRequest) []SimulationResult {
+	users := req.Users
+	if len(users) == 0 {
+		users = []Redeemer{{}}
+	}
+
+	var results []SimulationResult
+	for i, cart := range req.Carts {
+		cart.CouponCode = req.Coupon.CouponCode
+		for _, user := range users {
+			user := user
+			result := SimulationResult{CartIndex: i, UserID: user.UserID}
+
+			if reason := evaluateCoupon(req.Coupon, cart, &user); reason != "" {
+				result.Reason = reason
+			} else {
+				result.Eligible = true
+				result.ItemsDiscount, result.ChargesDiscount = calculateDiscount(req.Coupon, cart)
+				result.TotalDiscount = result.ItemsDiscount + result.ChargesDiscount
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
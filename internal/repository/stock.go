@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OutOfStockError is returned when an item does not have enough stock left
+// for the quantity asked for.
+type OutOfStockError struct {
+	ItemID    int
+	Available int
+}
+
+func (e *OutOfStockError) Error() string {
+	return "item " + strconv.Itoa(e.ItemID) + " has only " + strconv.Itoa(e.Available) + " left in stock"
+}
+
+// Reservation holds stock for a user's checkout until it expires or the
+// user places an order.
+type Reservation struct {
+	UserID    int         `json:"user_id"`
+	Items     []OrderLine `json:"items"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// reservedByOthers is the stock of items.id held by unexpired reservations
+// of users other than the one in userParam.
+func reservedByOthers(userParam, nowParam string) string {
+	return `COALESCE((SELECT SUM(r.quantity) FROM stock_reservations r
+                      WHERE r.item_id = items.id AND r.user_id <> ` + userParam + ` AND r.expires_at > ` + nowParam + `), 0)`
+}
+
+// mergeLines adds up repeated items and sorts the lines by item id, the
+// order in which item rows are locked.
+func mergeLines(lines []OrderLine) []OrderLine {
+	quantities := map[int]int{}
+	for _, line := range lines {
+		quantities[line.ItemID] += line.Quantity
+	}
+
+	merged := make([]OrderLine, 0, len(quantities))
+	for id, quantity := range quantities {
+		merged = append(merged, OrderLine{ItemID: id, Quantity: quantity})
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].ItemID < merged[j].ItemID })
+	return merged
+}
+
+// lockStock locks the item and returns its stock and how much of it the user
+// may take. Stock is NULL for items whose stock is not tracked.
+func lockStock(ctx context.Context, tx *sql.Tx, itemID, userID int, now time.Time) (sql.NullInt64, int, error) {
+	query := `SELECT stock, COALESCE(GREATEST(stock - ` + reservedByOthers("$2", "$3") + `, 0), 0)
+              FROM items WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+
+	var stock sql.NullInt64
+	var available int
+	err := tx.QueryRowContext(ctx, query, itemID, userID, now).Scan(&stock, &available)
+	if err == sql.ErrNoRows {
+		return stock, 0, ErrUnknownItem
+	}
+	return stock, available, err
+}
+
+// takeStock takes the ordered quantities out of stock, counting the user's
+// own reservation as available to them, and clears the reservation.
+func takeStock(ctx context.Context, tx *sql.Tx, userID int, items []OrderItem, now time.Time) error {
+	lines := make([]OrderLine, len(items))
+	for i, item := range items {
+		lines[i] = OrderLine{ItemID: item.ItemID, Quantity: item.Quantity}
+	}
+
+	for _, line := range mergeLines(lines) {
+		stock, available, err := lockStock(ctx, tx, line.ItemID, userID, now)
+		if err != nil {
+			return err
+		}
+		if !stock.Valid {
+			continue
+		}
+		if line.Quantity > available {
+			return &OutOfStockError{ItemID: line.ItemID, Available: available}
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE items SET stock = stock - $2 WHERE id = $1`, line.ItemID, line.Quantity); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, `DELETE FROM stock_reservations WHERE user_id = $1`, userID)
+	return err
+}
+
+// restockOrder puts the order's items back in stock. Returned units are left
+// out: medicines that have left the pharmacy cannot be resold.
+func restockOrder(ctx context.Context, tx execer, orderID int) error {
+	query := `UPDATE items SET stock = items.stock + oi.quantity - oi.returned_quantity
+              FROM order_items oi
+              WHERE oi.order_id = $1 AND items.id = oi.item_id AND items.stock IS NOT NULL`
+	_, err := tx.ExecContext(ctx, query, orderID)
+	return err
+}
+
+// Reserve holds stock for the user's cart for the repository's
+// ReservationTTL, replacing any reservation they already had. It returns
+// ErrUnknownUser, ErrUnknownItem or an *OutOfStockError if the cart cannot be
+// reserved.
+func (i *ItemRepository) Reserve(ctx context.Context, userID int, lines []OrderLine) (Reservation, error) {
+	res := Reservation{UserID: userID, Items: mergeLines(lines)}
+
+	tx, err := i.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return res, err
+	}
+	if !exists {
+		return res, ErrUnknownUser
+	}
+
+	now := time.Now()
+	for _, line := range res.Items {
+		stock, available, err := lockStock(ctx, tx, line.ItemID, userID, now)
+		if err != nil {
+			return res, err
+		}
+		if stock.Valid && line.Quantity > available {
+			return res, &OutOfStockError{ItemID: line.ItemID, Available: available}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM stock_reservations WHERE user_id = $1`, userID); err != nil {
+		return res, err
+	}
+
+	res.ExpiresAt = now.Add(i.ReservationTTL)
+	for _, line := range res.Items {
+		_, err := tx.ExecContext(ctx, `INSERT INTO stock_reservations (user_id, item_id, quantity, expires_at) VALUES ($1, $2, $3, $4)`,
+			userID, line.ItemID, line.Quantity, res.ExpiresAt)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	return res, tx.Commit()
+}
+
+// ReleaseReservation drops the user's reservation, if any.
+func (i *ItemRepository) ReleaseReservation(ctx context.Context, userID int) error {
+	_, err := i.DB.ExecContext(ctx, `DELETE FROM stock_reservations WHERE user_id = $1`, userID)
+	return err
+}
+
+// PruneReservations deletes reservations that expired before the given time.
+func (i *ItemRepository) PruneReservations(ctx context.Context, before time.Time) error {
+	_, err := i.DB.ExecContext(ctx, `DELETE FROM stock_reservations WHERE expires_at < $1`, before)
+	return err
+}
+
+// SetStock sets the item's stock, or stops tracking it if stock is nil. It
+// returns sql.ErrNoRows if the item does not exist or was deleted.
+func (i *ItemRepository) SetStock(ctx context.Context, id int, stock *int) error {
+	res, err := i.DB.ExecContext(ctx, `UPDATE items SET stock = $2 WHERE id = $1 AND deleted_at IS NULL`, id, stock)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// cartOutOfStock reports whether any of the cart's items has no stock left
+// for the user.
+func cartOutOfStock(ctx context.Context, q queryRower, items []CartItem, userID int) (bool, error) {
+	var ids []int64
+	for _, item := range items {
+		if id, err := strconv.ParseInt(item.ID, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return false, nil
+	}
+
+	query := `SELECT EXISTS (SELECT 1 FROM items
+                             WHERE id = ANY($1) AND stock IS NOT NULL AND stock - ` + reservedByOthers("$2", "$3") + ` <= 0)`
+
+	var out bool
+	err := q.QueryRowContext(ctx, query, pq.Array(ids), userID, time.Now()).Scan(&out)
+	return out, err
+}
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type UserCoupon struct {
+	UserID        int        `json:"user_id"`
+	CouponCode    string     `json:"coupon_code"`
+	MaxUses       int        `json:"max_uses"`
+	RemainingUses int        `json:"remaining_uses"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	AssignedAt    time.Time  `json:"assigned_at"`
+}
+
+type AssignCouponRequest struct {
+	UserIDs   []int      `json:"user_ids"`
+	MaxUses   int        `json:"max_uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// AssignCoupon issues the coupon to the given users. Once a coupon has been
+// issued to anyone it can only be redeemed by the users it was issued to. It
+// returns sql.ErrNoRows if the coupon does not exist and ErrUnknownUser if
+// any of the users does not.
+func (r *CouponRepository) AssignCoupon(ctx context.Context, couponCode string, req AssignCouponRequest) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	couponCode, err = lookupCouponCode(ctx, tx, NormalizeCode(couponCode))
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int64, len(req.UserIDs))
+	for i, id := range req.UserIDs {
+		ids[i] = int64(id)
+	}
+	var missing bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM UNNEST($1::int[]) AS ids(id) WHERE id NOT IN (SELECT id FROM users))`,
+		pq.Array(ids)).Scan(&missing)
+	if err != nil {
+		return err
+	}
+	if missing {
+		return ErrUnknownUser
+	}
+
+	query := `INSERT INTO user_coupons (user_id, coupon_code, max_uses, expires_at, assigned_at)
+              VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (user_id, coupon_code) DO UPDATE SET max_uses = EXCLUDED.max_uses, expires_at = EXCLUDED.expires_at`
+
+	now := time.Now()
+	for _, userID := range req.UserIDs {
+		if _, err := tx.ExecContext(ctx, query, userID, couponCode, req.MaxUses, req.ExpiresAt, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetUserCoupons lists the live coupons issued to a user that have not
+// expired, along with how many uses are left on each.
+func (r *CouponRepository) GetUserCoupons(ctx context.Context, userID int) ([]UserCoupon, error) {
+	query := `SELECT uc.user_id, uc.coupon_code, uc.max_uses, LEAST(uc.expires_at, c.expiry_date), uc.assigned_at,
+                     (SELECT COUNT(*) FROM order_coupons oc JOIN orders o ON o.id = oc.order_id
+                      WHERE oc.coupon_code = uc.coupon_code AND o.user_id = uc.user_id AND oc.released_at IS NULL)
+              FROM user_coupons uc
+              JOIN coupons c ON c.coupon_code = uc.coupon_code
+              WHERE uc.user_id = $1 AND c.status = 'live' AND c.expiry_date > $2 AND (uc.expires_at IS NULL OR uc.expires_at > $2)
+              ORDER BY uc.assigned_at DESC`
+
+	rows, err := r.DB.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []UserCoupon
+	for rows.Next() {
+		var uc UserCoupon
+		var expiresAt sql.NullTime
+		var used int
+		if err := rows.Scan(&uc.UserID, &uc.CouponCode, &uc.MaxUses, &expiresAt, &uc.AssignedAt, &used); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			uc.ExpiresAt = &expiresAt.Time
+		}
+
+		uc.RemainingUses = uc.MaxUses - used
+		if uc.RemainingUses <= 0 {
+			continue
+		}
+		coupons = append(coupons, uc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return coupons, nil
+}
+
+// checkUserCoupon reports whether userID may redeem couponCode given usageCount
+// prior redemptions. Coupons that were never issued to anyone are open to all.
+func (r *CouponRepository) checkUserCoupon(ctx context.Context, q queryRower, couponCode string, userID, usageCount int, at time.Time) (bool, error) {
+	query := `SELECT COUNT(*),
+                     COUNT(*) FILTER (WHERE user_id = $2),
+                     COALESCE(MAX(max_uses) FILTER (WHERE user_id = $2 AND (expires_at IS NULL OR expires_at > $3)), 0)
+              FROM user_coupons WHERE coupon_code = $1`
+
+	var assigned, assignedToUser, maxUses int
+	err := q.QueryRowContext(ctx, query, couponCode, userID, at).Scan(&assigned, &assignedToUser, &maxUses)
+	if err != nil {
+		return false, err
+	}
+
+	if assigned == 0 {
+		return true, nil
+	}
+	if assignedToUser == 0 {
+		return false, nil
+	}
+	return usageCount < maxUses, nil
+}
@@ -0,0 +1,296 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type scope struct {
+	env  map[string]interface{}
+	elem interface{}
+}
+
+type node interface {
+	eval(s *scope) (interface{}, error)
+}
+
+type literal struct{ value interface{} }
+
+type rootRef struct{ name string }
+
+type elemRef struct{}
+
+type member struct {
+	object node
+	field  string
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+type listLiteral struct{ elems []node }
+
+type call struct {
+	fn   string
+	args []node
+}
+
+func (n literal) eval(s *scope) (interface{}, error) { return n.value, nil }
+
+func (n rootRef) eval(s *scope) (interface{}, error) { return s.env[n.name], nil }
+
+func (n elemRef) eval(s *scope) (interface{}, error) { return s.elem, nil }
+
+func (n member) eval(s *scope) (interface{}, error) {
+	v, err := n.object.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot access field %q", n.field)
+	}
+	return obj[n.field], nil
+}
+
+func (n unary) eval(s *scope) (interface{}, error) {
+	v, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, err := asBool(v)
+		return !b, err
+	}
+	f, err := asNumber(v)
+	return -f, err
+}
+
+func (n binary) eval(s *scope) (interface{}, error) {
+	left, err := n.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators short-circuit
+	switch n.op {
+	case "&&", "||":
+		lb, err := asBool(left)
+		if err != nil {
+			return nil, err
+		}
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return lb, nil
+		}
+		right, err := n.right.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		return asBool(right)
+	}
+
+	right, err := n.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		list, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("right side of in is not a list")
+		}
+		for _, v := range list {
+			if equal(left, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "<", "<=", ">", ">=":
+		cmp, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	}
+
+	lf, err := asNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := asNumber(right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	case "%":
+		if int64(rf) == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return float64(int64(lf) % int64(rf)), nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+func (n listLiteral) eval(s *scope) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.elems))
+	for _, e := range n.elems {
+		v, err := e.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (n call) eval(s *scope) (interface{}, error) {
+	arg, err := n.args[0].eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.fn {
+	case "len":
+		switch v := arg.(type) {
+		case []interface{}:
+			return float64(len(v)), nil
+		case string:
+			return float64(utf8.RuneCountInString(v)), nil
+		}
+		return nil, fmt.Errorf("len expects a list or string")
+	case "lower", "upper":
+		str, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a string", n.fn)
+		}
+		if n.fn == "lower" {
+			return strings.ToLower(str), nil
+		}
+		return strings.ToUpper(str), nil
+	}
+
+	list, ok := arg.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s expects a list", n.fn)
+	}
+
+	var matched int
+	var total float64
+	for _, elem := range list {
+		v, err := n.args[1].eval(&scope{env: s.env, elem: elem})
+		if err != nil {
+			return nil, err
+		}
+		if n.fn == "sum" {
+			f, err := asNumber(v)
+			if err != nil {
+				return nil, err
+			}
+			total += f
+			continue
+		}
+		b, err := asBool(v)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			matched++
+			if n.fn == "any" {
+				return true, nil
+			}
+		} else if n.fn == "all" {
+			return false, nil
+		}
+	}
+
+	switch n.fn {
+	case "any":
+		return false, nil
+	case "all":
+		return true, nil
+	case "count":
+		return float64(matched), nil
+	}
+	return total, nil
+}
+
+func asBool(v interface{}) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, got %T", v)
+	}
+	return b, nil
+}
+
+func asNumber(v interface{}) (float64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, got %T", v)
+	}
+	return f, nil
+}
+
+func equal(a, b interface{}) bool {
+	switch a.(type) {
+	case float64, string, bool, nil:
+		return a == b
+	}
+	return false
+}
+
+func compare(a, b interface{}) (int, error) {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare number with %T", b)
+		}
+		switch {
+		case av < bv:
+			return -1, nil
+		case av > bv:
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare string with %T", b)
+		}
+		return strings.Compare(av, bv), nil
+	}
+	return 0, fmt.Errorf("cannot compare %T", a)
+}
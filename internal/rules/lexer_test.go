@@ -0,0 +1,105 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		src   string
+		kinds []tokenKind
+		texts []string
+	}{
+		{
+			src:   `cart.total >= 500`,
+			kinds: []tokenKind{tokIdent, tokDot, tokIdent, tokOp, tokNumber, tokEOF},
+			texts: []string{"cart", ".", "total", ">=", "500", ""},
+		},
+		{
+			src:   `any(cart.items, .price > 1.5)`,
+			kinds: []tokenKind{tokIdent, tokLParen, tokIdent, tokDot, tokIdent, tokComma, tokDot, tokIdent, tokOp, tokNumber, tokRParen, tokEOF},
+			texts: []string{"any", "(", "cart", ".", "items", ",", ".", "price", ">", "1.5", ")", ""},
+		},
+		{
+			src:   `context.city in ["Pune", 'Mumbai']`,
+			kinds: []tokenKind{tokIdent, tokDot, tokIdent, tokIdent, tokLBrack, tokString, tokComma, tokString, tokRBrack, tokEOF},
+			texts: []string{"context", ".", "city", "in", "[", "Pune", ",", "Mumbai", "]", ""},
+		},
+		{
+			src:   `"a\"b" != 'c'`,
+			kinds: []tokenKind{tokString, tokOp, tokString, tokEOF},
+			texts: []string{`a"b`, "!=", "c", ""},
+		},
+		{
+			src:   `.5 + -x`,
+			kinds: []tokenKind{tokNumber, tokOp, tokOp, tokIdent, tokEOF},
+			texts: []string{".5", "+", "-", "x", ""},
+		},
+		{
+			src:   `"Bengaluru – Indiranagar" == 'Zürich'`,
+			kinds: []tokenKind{tokString, tokOp, tokString, tokEOF},
+			texts: []string{"Bengaluru – Indiranagar", "==", "Zürich", ""},
+		},
+		{
+			src:   `größe && ñ1`,
+			kinds: []tokenKind{tokIdent, tokOp, tokIdent, tokEOF},
+			texts: []string{"größe", "&&", "ñ1", ""},
+		},
+		{
+			src:   " a ",
+			kinds: []tokenKind{tokIdent, tokEOF},
+			texts: []string{"a", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			tokens, err := lex(tt.src)
+			if err != nil {
+				t.Fatalf("lex: %v", err)
+			}
+			var kinds []tokenKind
+			var texts []string
+			for _, tok := range tokens {
+				kinds = append(kinds, tok.kind)
+				texts = append(texts, tok.text)
+			}
+			if !reflect.DeepEqual(kinds, tt.kinds) {
+				t.Errorf("kinds = %v, want %v", kinds, tt.kinds)
+			}
+			if !reflect.DeepEqual(texts, tt.texts) {
+				t.Errorf("texts = %q, want %q", texts, tt.texts)
+			}
+		})
+	}
+}
+
+func TestLexPositions(t *testing.T) {
+	tokens, err := lex(`"é" == x`)
+	if err != nil {
+		t.Fatalf("lex: %v", err)
+	}
+	// Positions are byte offsets, so the two-byte é moves the operator by two
+	if got := []int{tokens[0].pos, tokens[1].pos, tokens[2].pos}; !reflect.DeepEqual(got, []int{0, 5, 8}) {
+		t.Errorf("positions = %v, want [0 5 8]", got)
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []string{
+		`"unterminated`,
+		`'unterminated`,
+		`1.2.3`,
+		`a # b`,
+		`a ≥ b`,
+		"a == \xff",
+		`"bad \q escape"`,
+	}
+
+	for _, src := range tests {
+		if _, err := lex(src); err == nil {
+			t.Errorf("lex(%q) succeeded, want an error", src)
+		}
+	}
+}
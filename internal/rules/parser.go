@@ -0,0 +1,372 @@
+package rules
+
+import (
+	"fmt"
+)
+
+// maxDepth bounds expression nesting so hostile input cannot exhaust the stack.
+const maxDepth = 32
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+	roots  map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	t := p.peek()
+	if t.kind == kind && (text == "" || t.text == text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		t := p.peek()
+		if t.kind == tokEOF {
+			return fmt.Errorf("unexpected end of expression, expected %q", text)
+		}
+		return fmt.Errorf("unexpected %q at position %d, expected %q", t.text, t.pos, text)
+	}
+	return nil
+}
+
+// Every parse function receives the schema of the current list element (nil
+// outside predicates) and returns the node along with its static schema.
+
+func (p *parser) parseExpr(elem *schema) (node, *schema, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, nil, fmt.Errorf("expression nested too deeply")
+	}
+	return p.parseOr(elem)
+}
+
+func (p *parser) parseOr(elem *schema) (node, *schema, error) {
+	left, ls, err := p.parseAnd(elem)
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.accept(tokOp, "||") {
+		right, rs, err := p.parseAnd(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := expectKind("||", kindBool, ls, rs); err != nil {
+			return nil, nil, err
+		}
+		left, ls = binary{op: "||", left: left, right: right}, boolSchema
+	}
+	return left, ls, nil
+}
+
+func (p *parser) parseAnd(elem *schema) (node, *schema, error) {
+	left, ls, err := p.parseComparison(elem)
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.accept(tokOp, "&&") {
+		right, rs, err := p.parseComparison(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := expectKind("&&", kindBool, ls, rs); err != nil {
+			return nil, nil, err
+		}
+		left, ls = binary{op: "&&", left: left, right: right}, boolSchema
+	}
+	return left, ls, nil
+}
+
+func (p *parser) parseComparison(elem *schema) (node, *schema, error) {
+	left, ls, err := p.parseAdditive(elem)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!="):
+		p.next()
+		right, rs, err := p.parseAdditive(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ls.kind != kindAny && rs.kind != kindAny && ls.kind != rs.kind {
+			return nil, nil, fmt.Errorf("cannot compare %s with %s using %s", ls.kind, rs.kind, t.text)
+		}
+		return binary{op: t.text, left: left, right: right}, boolSchema, nil
+	case t.kind == tokOp && (t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		p.next()
+		right, rs, err := p.parseAdditive(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ls.kind != kindAny && rs.kind != kindAny && (ls.kind != rs.kind || (ls.kind != kindNumber && ls.kind != kindString)) {
+			return nil, nil, fmt.Errorf("cannot order %s and %s using %s", ls.kind, rs.kind, t.text)
+		}
+		return binary{op: t.text, left: left, right: right}, boolSchema, nil
+	case t.kind == tokIdent && t.text == "in":
+		p.next()
+		right, rs, err := p.parseAdditive(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rs.kind != kindAny && rs.kind != kindList {
+			return nil, nil, fmt.Errorf("right side of in must be a list, got %s", rs.kind)
+		}
+		return binary{op: "in", left: left, right: right}, boolSchema, nil
+	}
+	return left, ls, nil
+}
+
+func (p *parser) parseAdditive(elem *schema) (node, *schema, error) {
+	left, ls, err := p.parseMultiplicative(elem)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "+" && t.text != "-") {
+			return left, ls, nil
+		}
+		p.next()
+		right, rs, err := p.parseMultiplicative(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := expectKind(t.text, kindNumber, ls, rs); err != nil {
+			return nil, nil, err
+		}
+		left, ls = binary{op: t.text, left: left, right: right}, numberSchema
+	}
+}
+
+func (p *parser) parseMultiplicative(elem *schema) (node, *schema, error) {
+	left, ls, err := p.parseUnary(elem)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return left, ls, nil
+		}
+		p.next()
+		right, rs, err := p.parseUnary(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := expectKind(t.text, kindNumber, ls, rs); err != nil {
+			return nil, nil, err
+		}
+		left, ls = binary{op: t.text, left: left, right: right}, numberSchema
+	}
+}
+
+func (p *parser) parseUnary(elem *schema) (node, *schema, error) {
+	t := p.peek()
+	if t.kind == tokOp && (t.text == "!" || t.text == "-") {
+		p.next()
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxDepth {
+			return nil, nil, fmt.Errorf("expression nested too deeply")
+		}
+		operand, os, err := p.parseUnary(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.text == "!" {
+			if err := expectKind("!", kindBool, os); err != nil {
+				return nil, nil, err
+			}
+			return unary{op: "!", operand: operand}, boolSchema, nil
+		}
+		if err := expectKind("-", kindNumber, os); err != nil {
+			return nil, nil, err
+		}
+		return unary{op: "-", operand: operand}, numberSchema, nil
+	}
+	return p.parsePostfix(elem)
+}
+
+func (p *parser) parsePostfix(elem *schema) (node, *schema, error) {
+	n, s, err := p.parsePrimary(elem)
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.accept(tokDot, "") {
+		n, s, err = p.parseField(n, s)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return n, s, nil
+}
+
+func (p *parser) parseField(obj node, s *schema) (node, *schema, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return nil, nil, fmt.Errorf("expected field name at position %d", t.pos)
+	}
+	if s.kind != kindObject {
+		return nil, nil, fmt.Errorf("cannot access field %q on %s", t.text, s.kind)
+	}
+	fs, ok := s.fields[t.text]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown field %q", t.text)
+	}
+	return member{object: obj, field: t.text}, fs, nil
+}
+
+func (p *parser) parsePrimary(elem *schema) (node, *schema, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return literal{value: t.num}, numberSchema, nil
+	case tokString:
+		return literal{value: t.text}, stringSchema, nil
+	case tokLParen:
+		n, s, err := p.parseExpr(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, nil, err
+		}
+		return n, s, nil
+	case tokLBrack:
+		var elems []node
+		var es *schema
+		for !p.accept(tokRBrack, "") {
+			if len(elems) > 0 {
+				if err := p.expect(tokComma, ","); err != nil {
+					return nil, nil, err
+				}
+			}
+			n, s, err := p.parseExpr(elem)
+			if err != nil {
+				return nil, nil, err
+			}
+			if es == nil {
+				es = s
+			} else if es.kind != s.kind {
+				es = anySchema
+			}
+			elems = append(elems, n)
+		}
+		if es == nil {
+			es = anySchema
+		}
+		return listLiteral{elems: elems}, &schema{kind: kindList, elem: es}, nil
+	case tokDot:
+		// A leading dot refers to the current element inside a predicate
+		if elem == nil {
+			return nil, nil, fmt.Errorf("element reference at position %d used outside of a list function", t.pos)
+		}
+		if p.peek().kind != tokIdent {
+			return elemRef{}, elem, nil
+		}
+		return p.parseField(elemRef{}, elem)
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{value: true}, boolSchema, nil
+		case "false":
+			return literal{value: false}, boolSchema, nil
+		}
+		if p.accept(tokLParen, "") {
+			return p.parseCall(t, elem)
+		}
+		s, ok := envSchema.fields[t.text]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown identifier %q", t.text)
+		}
+		p.roots[t.text] = true
+		return rootRef{name: t.text}, s, nil
+	case tokEOF:
+		return nil, nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseCall(name token, elem *schema) (node, *schema, error) {
+	switch name.text {
+	case "any", "all", "count", "sum":
+		list, ls, err := p.parseExpr(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ls.kind != kindList {
+			return nil, nil, fmt.Errorf("%s expects a list, got %s", name.text, ls.kind)
+		}
+		if err := p.expect(tokComma, ","); err != nil {
+			return nil, nil, err
+		}
+		pred, ps, err := p.parseExpr(ls.elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, nil, err
+		}
+		if name.text == "sum" {
+			if err := expectKind("sum", kindNumber, ps); err != nil {
+				return nil, nil, err
+			}
+			return call{fn: name.text, args: []node{list, pred}}, numberSchema, nil
+		}
+		if err := expectKind(name.text, kindBool, ps); err != nil {
+			return nil, nil, err
+		}
+		if name.text == "count" {
+			return call{fn: name.text, args: []node{list, pred}}, numberSchema, nil
+		}
+		return call{fn: name.text, args: []node{list, pred}}, boolSchema, nil
+	case "len", "lower", "upper":
+		arg, as, err := p.parseExpr(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, nil, err
+		}
+		if name.text == "len" {
+			if as.kind != kindAny && as.kind != kindList && as.kind != kindString {
+				return nil, nil, fmt.Errorf("len expects a list or string, got %s", as.kind)
+			}
+			return call{fn: name.text, args: []node{arg}}, numberSchema, nil
+		}
+		if err := expectKind(name.text, kindString, as); err != nil {
+			return nil, nil, err
+		}
+		return call{fn: name.text, args: []node{arg}}, stringSchema, nil
+	}
+	return nil, nil, fmt.Errorf("unknown function %q", name.text)
+}
+
+func expectKind(op string, want kind, operands ...*schema) error {
+	for _, s := range operands {
+		if s.kind != kindAny && s.kind != want {
+			return fmt.Errorf("%s expects %s operands, got %s", op, want, s.kind)
+		}
+	}
+	return nil
+}
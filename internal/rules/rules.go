@@ -0,0 +1,267 @@
+// Package rules implements a small expression language for coupon
+// eligibility, e.g.
+//
+//	cart.total >= 500 && any(cart.items, .category == "vitamins") && user.order_count == 0
+//
+// Expressions are side-effect free, can only read the Env they are evaluated
+// against and are type checked against its schema when compiled.
+package rules
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// MaxLength bounds the size of a stored expression.
+const MaxLength = 2000
+
+type Item struct {
+	ID       string
+	Name     string
+	Category string
+	Price    float64
+}
+
+type Cart struct {
+	Total    float64 // order total including charges
+	Subtotal float64 // sum of item prices
+	Items    []Item
+}
+
+type User struct {
+	ID             int
+	OrderCount     int // orders placed, not counting cancelled ones
+	AccountAgeDays int
+}
+
+type Context struct {
+	Channel       string
+	PaymentMethod string
+	AppVersion    string
+	Pincode       string
+	City          string
+	State         string
+	Hour          int // 0-23
+	Weekday       int // 0 = Sunday
+}
+
+// Env is the data an expression is evaluated against, exposed to expressions
+// as cart, user and context.
+type Env struct {
+	Cart    Cart
+	User    User
+	Context Context
+}
+
+type kind int
+
+const (
+	kindAny kind = iota
+	kindNumber
+	kindString
+	kindBool
+	kindList
+	kindObject
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	case kindBool:
+		return "boolean"
+	case kindList:
+		return "list"
+	case kindObject:
+		return "object"
+	}
+	return "any"
+}
+
+type schema struct {
+	kind   kind
+	fields map[string]*schema
+	elem   *schema
+}
+
+var (
+	anySchema    = &schema{kind: kindAny}
+	numberSchema = &schema{kind: kindNumber}
+	stringSchema = &schema{kind: kindString}
+	boolSchema   = &schema{kind: kindBool}
+)
+
+var itemSchema = &schema{kind: kindObject, fields: map[string]*schema{
+	"id":       stringSchema,
+	"name":     stringSchema,
+	"category": stringSchema,
+	"price":    numberSchema,
+}}
+
+var envSchema = &schema{kind: kindObject, fields: map[string]*schema{
+	"cart": {kind: kindObject, fields: map[string]*schema{
+		"total":      numberSchema,
+		"subtotal":   numberSchema,
+		"item_count": numberSchema,
+		"items":      {kind: kindList, elem: itemSchema},
+	}},
+	"user": {kind: kindObject, fields: map[string]*schema{
+		"id":               numberSchema,
+		"order_count":      numberSchema,
+		"account_age_days": numberSchema,
+	}},
+	"context": {kind: kindObject, fields: map[string]*schema{
+		"channel":        stringSchema,
+		"payment_method": stringSchema,
+		"app_version":    stringSchema,
+		"pincode":        stringSchema,
+		"city":           stringSchema,
+		"state":          stringSchema,
+		"hour":           numberSchema,
+		"weekday":        numberSchema,
+	}},
+}}
+
+type Program struct {
+	source string
+	root   node
+	roots  map[string]bool
+}
+
+// Compile parses and type checks an expression. The expression must evaluate
+// to a boolean.
+func Compile(source string) (*Program, error) {
+	if len(source) > MaxLength {
+		return nil, fmt.Errorf("expression longer than %d characters", MaxLength)
+	}
+
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, roots: map[string]bool{}}
+	root, s, err := p.parseExpr(nil)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+	if s.kind != kindBool {
+		return nil, fmt.Errorf("expression must evaluate to a boolean, got %s", s.kind)
+	}
+
+	return &Program{source: source, root: root, roots: p.roots}, nil
+}
+
+// cacheSize bounds how many compiled programs Cached keeps. Expressions come
+// from simulations, backtests and imports as well as saved coupons, so the
+// least recently used ones are dropped rather than kept forever.
+const cacheSize = 1024
+
+var compiled = newProgramCache(cacheSize)
+
+// Cached returns the compiled program for source, compiling it on first use.
+func Cached(source string) (*Program, error) {
+	return compiled.get(source)
+}
+
+type programCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of *Program, most recently used first
+	items map[string]*list.Element
+}
+
+func newProgramCache(size int) *programCache {
+	return &programCache{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *programCache) get(source string) (*Program, error) {
+	c.mu.Lock()
+	if e, ok := c.items[source]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*Program), nil
+	}
+	c.mu.Unlock()
+
+	// Compiled outside the lock; a concurrent compile of the same source
+	// just stores an equivalent program
+	p, err := Compile(source)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[source]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*Program), nil
+	}
+	c.items[source] = c.order.PushFront(p)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*Program).source)
+	}
+	return p, nil
+}
+
+func (p *Program) String() string {
+	return p.source
+}
+
+// References reports whether the expression reads the given top-level name
+// (cart, user or context).
+func (p *Program) References(name string) bool {
+	return p.roots[name]
+}
+
+func (p *Program) Eval(env Env) (bool, error) {
+	v, err := p.root.eval(&scope{env: env.values()})
+	if err != nil {
+		return false, err
+	}
+	return asBool(v)
+}
+
+func (env Env) values() map[string]interface{} {
+	items := make([]interface{}, 0, len(env.Cart.Items))
+	for _, item := range env.Cart.Items {
+		items = append(items, map[string]interface{}{
+			"id":       item.ID,
+			"name":     item.Name,
+			"category": item.Category,
+			"price":    item.Price,
+		})
+	}
+
+	return map[string]interface{}{
+		"cart": map[string]interface{}{
+			"total":      env.Cart.Total,
+			"subtotal":   env.Cart.Subtotal,
+			"item_count": float64(len(env.Cart.Items)),
+			"items":      items,
+		},
+		"user": map[string]interface{}{
+			"id":               float64(env.User.ID),
+			"order_count":      float64(env.User.OrderCount),
+			"account_age_days": float64(env.User.AccountAgeDays),
+		},
+		"context": map[string]interface{}{
+			"channel":        env.Context.Channel,
+			"payment_method": env.Context.PaymentMethod,
+			"app_version":    env.Context.AppVersion,
+			"pincode":        env.Context.Pincode,
+			"city":           env.Context.City,
+			"state":          env.Context.State,
+			"hour":           float64(env.Context.Hour),
+			"weekday":        float64(env.Context.Weekday),
+		},
+	}
+}
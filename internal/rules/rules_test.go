@@ -0,0 +1,216 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+var testEnv = Env{
+	Cart: Cart{
+		Total:    650,
+		Subtotal: 600,
+		Items: []Item{
+			{ID: "1", Name: "Paracetamol", Category: "Pain Relief", Price: 100},
+			{ID: "2", Name: "Vitamin C", Category: "Vitamins", Price: 200},
+			{ID: "3", Name: "Crème", Category: "Soins – Peau", Price: 300},
+		},
+	},
+	User: User{ID: 7, OrderCount: 0, AccountAgeDays: 12},
+	Context: Context{
+		Channel:       "app",
+		PaymentMethod: "upi",
+		AppVersion:    "4.12.1",
+		City:          "Zürich",
+		Hour:          21,
+		Weekday:       5,
+	},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`cart.total >= 500`, true},
+		{`cart.total > 650`, false},
+		{`cart.subtotal == 600 && cart.item_count == 3`, true},
+		{`user.order_count == 0 || cart.total < 100`, true},
+		{`!(user.order_count == 0)`, false},
+		{`-cart.total < 0`, true},
+		{`cart.total - cart.subtotal == 50`, true},
+		{`cart.subtotal * 2 / 4 == 300`, true},
+		{`cart.total % 100 == 50`, true},
+		{`1 + 2 * 3 == 7`, true},
+		{`(1 + 2) * 3 == 9`, true},
+		{`any(cart.items, .category == "Vitamins")`, true},
+		{`any(cart.items, .price > 1000)`, false},
+		{`all(cart.items, .price >= 100)`, true},
+		{`all(cart.items, .price > 100)`, false},
+		{`count(cart.items, .price > 150) == 2`, true},
+		{`sum(cart.items, .price) == 600`, true},
+		{`context.channel in ["app", "web"]`, true},
+		{`context.channel in ["pos"]`, false},
+		{`lower(context.channel) == "app" && upper(context.payment_method) == "UPI"`, true},
+		{`context.city == "Zürich"`, true},
+		{`len(context.city) == 6`, true},
+		{`any(cart.items, .category == "Soins – Peau" && len(.name) == 5)`, true},
+		{`len(cart.items) == 3`, true},
+		{`context.app_version >= "4.1"`, true},
+		{`context.hour >= 18 && context.weekday == 5`, true},
+		{`user.account_age_days < 30 && user.id == 7`, true},
+		// The right side is not evaluated once the result is known
+		{`false && 1 / 0 == 1`, false},
+		{`true || 1 / 0 == 1`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			p, err := Compile(tt.expr)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			got, err := p.Eval(testEnv)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Eval = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []string{
+		`cart.total / 0 > 1`,
+		`cart.total % 0 > 1`,
+		`cart.total % 0.5 > 1`,
+	}
+
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			p, err := Compile(expr)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			if _, err := p.Eval(testEnv); err == nil {
+				t.Error("Eval succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string // part of the error message
+	}{
+		{``, "unexpected end"},
+		{`cart.total`, "must evaluate to a boolean"},
+		{`cart.total + "a" > 1`, "expects number operands"},
+		{`cart.total == "500"`, "cannot compare number with string"},
+		{`cart.items < 1`, "cannot order"},
+		{`true && 1`, "expects boolean operands"},
+		{`!cart.total`, "expects boolean operands"},
+		{`-context.city == 1`, "expects number operands"},
+		{`cart.missing > 1`, `unknown field "missing"`},
+		{`order.total > 1`, `unknown identifier "order"`},
+		{`cart.total.x > 1`, "cannot access field"},
+		{`.price > 1`, "outside of a list function"},
+		{`any(cart.total, .price > 1)`, "expects a list"},
+		{`any(cart.items, .price)`, "expects boolean operands"},
+		{`sum(cart.items, .name) > 1`, "expects number operands"},
+		{`len(cart.total) > 1`, "len expects a list or string"},
+		{`lower(cart.total) == "a"`, "expects string operands"},
+		{`exec("rm") == 1`, `unknown function "exec"`},
+		{`cart.total in 5`, "must be a list"},
+		{`(cart.total > 1`, `expected ")"`},
+		{`cart.total > 1)`, "unexpected"},
+		{`[1, 2 3]`, `expected ","`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Compile(tt.expr)
+			if err == nil {
+				t.Fatal("Compile succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+	long := "cart.total > 1" + strings.Repeat(" ", MaxLength)
+	if _, err := Compile(long); err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("Compile(long) error = %v, want length error", err)
+	}
+
+	nested := strings.Repeat("(", maxDepth+1) + "true" + strings.Repeat(")", maxDepth+1)
+	if _, err := Compile(nested); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("Compile(nested parens) error = %v, want depth error", err)
+	}
+
+	negated := strings.Repeat("!", maxDepth+1) + "true"
+	if _, err := Compile(negated); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("Compile(nested negation) error = %v, want depth error", err)
+	}
+
+	shallow := strings.Repeat("(", maxDepth-1) + "true" + strings.Repeat(")", maxDepth-1)
+	if _, err := Compile(shallow); err != nil {
+		t.Errorf("Compile(shallow) error = %v", err)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	p, err := Compile(`cart.total > 1 && any(cart.items, .price > 1)`)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	if !p.References("cart") || p.References("user") || p.References("context") {
+		t.Errorf("References = cart:%v user:%v context:%v, want only cart",
+			p.References("cart"), p.References("user"), p.References("context"))
+	}
+}
+
+func TestProgramCache(t *testing.T) {
+	c := newProgramCache(2)
+
+	a, err := c.get(`cart.total > 1`)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if again, _ := c.get(`cart.total > 1`); again != a {
+		t.Error("cached program was compiled again")
+	}
+
+	if _, err := c.get(`cart.total > 2`); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	// Using a makes cart.total > 2 the least recently used
+	c.get(`cart.total > 1`)
+	if _, err := c.get(`cart.total > 3`); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if c.order.Len() != 2 || len(c.items) != 2 {
+		t.Fatalf("cache holds %d programs (%d keys), want 2", c.order.Len(), len(c.items))
+	}
+	if _, ok := c.items[`cart.total > 2`]; ok {
+		t.Error("least recently used program was not evicted")
+	}
+	if _, ok := c.items[`cart.total > 1`]; !ok {
+		t.Error("recently used program was evicted")
+	}
+
+	if _, err := c.get(`cart.total >`); err == nil {
+		t.Error("get succeeded for an invalid expression")
+	}
+	if len(c.items) != 2 {
+		t.Error("invalid expression was cached")
+	}
+}
@@ -0,0 +1,63 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// MemoryStore keeps records in process memory. Records are not shared
+// between instances; use PostgresStore when running more than one.
+type MemoryStore struct {
+	mu    sync.Mutex
+	cache *cache.Cache
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{cache: cache.New(cache.NoExpiration, 10*time.Minute)}
+}
+
+func (s *MemoryStore) AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rec Record
+	if cached, found := s.cache.Get(key); found {
+		rec = cached.(Record)
+	}
+	if now.Sub(rec.LastFailure) > window {
+		rec = Record{}
+	}
+	prev := rec
+	rec.Failures++
+	rec.LastFailure = now
+
+	s.cache.Set(key, rec, window)
+	return prev, nil
+}
+
+func (s *MemoryStore) RemoveFailure(ctx context.Context, key string, at time.Time, prev Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached, expires, found := s.cache.GetWithExpiration(key)
+	if !found {
+		return nil
+	}
+	rec := cached.(Record)
+	if rec.Failures > 0 {
+		rec.Failures--
+	}
+	if rec.LastFailure.Equal(at) && !prev.LastFailure.IsZero() {
+		rec.LastFailure = prev.LastFailure
+	}
+
+	if ttl := time.Until(expires); ttl > 0 {
+		s.cache.Set(key, rec, ttl)
+	} else {
+		s.cache.Delete(key)
+	}
+	return nil
+}
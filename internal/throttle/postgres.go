@@ -0,0 +1,54 @@
+package throttle
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps records in the failed_attempts table so that every
+// instance sees the same counts.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (Record, error) {
+	// SET reads the row as it was before the update, which is how the
+	// previous last failure is returned
+	query := `INSERT INTO failed_attempts (key, failures, last_failure) VALUES ($1, 1, $2)
+              ON CONFLICT (key) DO UPDATE SET
+                  failures = CASE WHEN failed_attempts.last_failure < $3 THEN 1 ELSE failed_attempts.failures + 1 END,
+                  previous_failure = CASE WHEN failed_attempts.last_failure < $3 THEN NULL ELSE failed_attempts.last_failure END,
+                  last_failure = EXCLUDED.last_failure
+              RETURNING failures, previous_failure`
+
+	var failures int
+	var previous sql.NullTime
+	if err := s.DB.QueryRowContext(ctx, query, key, now, now.Add(-window)).Scan(&failures, &previous); err != nil {
+		return Record{}, err
+	}
+	return Record{Failures: failures - 1, LastFailure: previous.Time}, nil
+}
+
+func (s *PostgresStore) RemoveFailure(ctx context.Context, key string, at time.Time, prev Record) error {
+	var previous sql.NullTime
+	if !prev.LastFailure.IsZero() {
+		previous = sql.NullTime{Time: prev.LastFailure, Valid: true}
+	}
+
+	query := `UPDATE failed_attempts SET failures = GREATEST(failures - 1, 0),
+                  last_failure = CASE WHEN last_failure = $2 AND $3::timestamp IS NOT NULL THEN $3 ELSE last_failure END
+              WHERE key = $1`
+	_, err := s.DB.ExecContext(ctx, query, key, at, previous)
+	return err
+}
+
+// Prune deletes records whose last failure is before the given time.
+func (s *PostgresStore) Prune(ctx context.Context, before time.Time) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM failed_attempts WHERE last_failure < $1`, before)
+	return err
+}
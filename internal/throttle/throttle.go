@@ -0,0 +1,134 @@
+// Package throttle slows down repeated failures, such as guessing coupon
+// codes, with exponential backoff and a temporary lockout per key.
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+// Record is the failure history kept for a key.
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// Store keeps failure records. Implementations must make AddFailure and
+// RemoveFailure atomic so that concurrent attempts are all counted.
+type Store interface {
+	// AddFailure records a failure at now and returns the record as it was
+	// before. A record whose last failure is older than window starts over
+	// and is returned as a zero Record.
+	AddFailure(ctx context.Context, key string, now time.Time, window time.Duration) (Record, error)
+	// RemoveFailure takes back a failure added at the given time, restoring
+	// the previous last failure unless another failure was added since.
+	RemoveFailure(ctx context.Context, key string, at time.Time, prev Record) error
+}
+
+type Policy struct {
+	FreeAttempts    int           // failures allowed before any delay
+	BaseDelay       time.Duration // delay after the first failure past FreeAttempts, doubled for each one after
+	MaxDelay        time.Duration // cap on the backoff delay
+	LockoutAfter    int           // failures that lock the key out entirely
+	LockoutDuration time.Duration
+	Window          time.Duration // failures are forgotten after this long without another, or the lockout if longer
+}
+
+// Retention is how long a record must be kept: long enough to both forget
+// failures after Window and outlast a lockout.
+func (p Policy) Retention() time.Duration {
+	if p.LockoutDuration > p.Window {
+		return p.LockoutDuration
+	}
+	return p.Window
+}
+
+// blockedUntil returns when the key may next be tried.
+func (p Policy) blockedUntil(rec Record) time.Time {
+	switch {
+	case p.LockoutAfter > 0 && rec.Failures >= p.LockoutAfter:
+		return rec.LastFailure.Add(p.LockoutDuration)
+	case rec.Failures <= p.FreeAttempts:
+		return time.Time{}
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < rec.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return rec.LastFailure.Add(delay)
+}
+
+// Limiter applies a Policy to the records in a Store. Every attempt is
+// counted as a failure before it is checked, so concurrent attempts cannot
+// all get past the backoff before any of them has failed. An attempt that
+// turns out not to be a failure only takes back its own count, otherwise a
+// known valid code could be used to reset the count between guesses;
+// failures are only forgotten after the policy's Window.
+type Limiter struct {
+	Store  Store
+	Policy Policy
+}
+
+func NewLimiter(store Store, policy Policy) *Limiter {
+	return &Limiter{Store: store, Policy: policy}
+}
+
+// Attempt is an attempt counted against a set of keys.
+type Attempt struct {
+	limiter *Limiter
+	at      time.Time
+	keys    []string
+	prev    []Record // records before the attempt, by key
+}
+
+// Begin counts an attempt against every key. If any key must wait, the
+// attempt is taken back and Begin returns how long the caller must wait,
+// the longest across keys. Otherwise the attempt stays counted as a failure
+// unless the caller ends it with Succeed.
+func (l *Limiter) Begin(ctx context.Context, keys ...string) (*Attempt, time.Duration, error) {
+	// Stores may only keep microseconds, and must see the same time when
+	// the attempt is taken back
+	a := &Attempt{limiter: l, at: time.Now().Truncate(time.Microsecond)}
+
+	var wait time.Duration
+	for _, key := range keys {
+		prev, err := l.Store.AddFailure(ctx, key, a.at, l.Policy.Retention())
+		if err != nil {
+			a.Succeed(ctx)
+			return nil, 0, err
+		}
+		a.keys = append(a.keys, key)
+		a.prev = append(a.prev, prev)
+
+		if d := l.Policy.blockedUntil(prev).Sub(a.at); d > wait {
+			wait = d
+		}
+	}
+
+	if wait > 0 {
+		if err := a.Succeed(ctx); err != nil {
+			return nil, 0, err
+		}
+		return nil, wait, nil
+	}
+	return a, 0, nil
+}
+
+// Succeed takes the attempt back, for attempts that turned out not to be
+// failures. It does nothing on a nil Attempt.
+func (a *Attempt) Succeed(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	for i, key := range a.keys {
+		if err := a.limiter.Store.RemoveFailure(ctx, key, a.at, a.prev[i]); err != nil {
+			return err
+		}
+	}
+	a.keys, a.prev = nil, nil
+	return nil
+}
@@ -0,0 +1,155 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts:    2,
+	BaseDelay:       time.Second,
+	MaxDelay:        10 * time.Second,
+	LockoutAfter:    8,
+	LockoutDuration: time.Hour,
+	Window:          30 * time.Minute,
+}
+
+func TestBlockedUntil(t *testing.T) {
+	last := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures int
+		want     time.Duration // after last, or 0 for not blocked
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+
+	for _, tt := range tests {
+		got := testPolicy.blockedUntil(Record{Failures: tt.failures, LastFailure: last})
+		var want time.Time
+		if tt.want > 0 {
+			want = last.Add(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("blockedUntil(%d failures) = %v, want %v", tt.failures, got, want)
+		}
+	}
+}
+
+func TestLimiterBlocksAfterFreeAttempts(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter(NewMemoryStore(), testPolicy)
+
+	for i := 0; i < testPolicy.FreeAttempts+1; i++ {
+		if _, wait, err := l.Begin(ctx, "user", "ip"); err != nil || wait > 0 {
+			t.Fatalf("attempt %d: wait = %v, err = %v, want allowed", i+1, wait, err)
+		}
+	}
+
+	_, wait, err := l.Begin(ctx, "user", "ip")
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if wait <= 0 || wait > testPolicy.BaseDelay {
+		t.Errorf("wait = %v, want up to %v", wait, testPolicy.BaseDelay)
+	}
+
+	// A blocked attempt is not counted
+	rec, _ := l.Store.(*MemoryStore).cache.Get("user")
+	if got := rec.(Record).Failures; got != testPolicy.FreeAttempts+1 {
+		t.Errorf("failures = %d, want %d", got, testPolicy.FreeAttempts+1)
+	}
+
+	// Keys are limited separately, but any blocked key blocks the attempt
+	if _, wait, _ := l.Begin(ctx, "other", "ip"); wait <= 0 {
+		t.Error("attempt from a blocked IP was allowed")
+	}
+	if _, wait, _ := l.Begin(ctx, "other"); wait > 0 {
+		t.Errorf("unrelated key must wait %v", wait)
+	}
+}
+
+func TestLimiterSucceed(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	l := NewLimiter(store, testPolicy)
+
+	if _, _, err := l.Begin(ctx, "user"); err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	before, _ := store.cache.Get("user")
+
+	time.Sleep(time.Millisecond)
+	a, _, err := l.Begin(ctx, "user")
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := a.Succeed(ctx); err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+
+	// Only the successful attempt is taken back
+	after, _ := store.cache.Get("user")
+	if after.(Record) != before.(Record) {
+		t.Errorf("record = %+v, want %+v", after, before)
+	}
+
+	var none *Attempt
+	if err := none.Succeed(ctx); err != nil {
+		t.Errorf("nil Succeed: %v", err)
+	}
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter(NewMemoryStore(), testPolicy)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, wait, err := l.Begin(ctx, "user"); err == nil && wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Attempts are counted before they are checked, so only the free ones
+	// and the first delayed one get through
+	if allowed != testPolicy.FreeAttempts+1 {
+		t.Errorf("allowed %d concurrent attempts, want %d", allowed, testPolicy.FreeAttempts+1)
+	}
+}
+
+func TestMemoryStoreWindow(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	start := time.Now()
+
+	store.AddFailure(ctx, "user", start, time.Minute)
+	prev, _ := store.AddFailure(ctx, "user", start.Add(30*time.Second), time.Minute)
+	if prev.Failures != 1 || !prev.LastFailure.Equal(start) {
+		t.Errorf("prev = %+v, want 1 failure at %v", prev, start)
+	}
+
+	prev, _ = store.AddFailure(ctx, "user", start.Add(2*time.Minute), time.Minute)
+	if prev != (Record{}) {
+		t.Errorf("prev = %+v after the window, want a zero record", prev)
+	}
+}
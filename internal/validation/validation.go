@@ -0,0 +1,130 @@
+// Package validation checks request payloads and reports every problem at
+// once as field-level errors addressed by JSON pointer (RFC 6901).
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Siddheshk02/coupon-system/internal/repository"
+	"github.com/Siddheshk02/coupon-system/internal/rules"
+)
+
+// maxCodeLength matches the coupon_code column.
+const maxCodeLength = 50
+
+var versionPattern = regexp.MustCompile(`^v?\d+(\.\d+)*$`)
+
+type FieldError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Pointer+": "+fe.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *Errors) add(pointer, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// Coupon validates a coupon definition. The expiry date must be after now.
+// It returns nil if the coupon is valid.
+func Coupon(c repository.Coupon, now time.Time) Errors {
+	var errs Errors
+
+	switch {
+	case strings.TrimSpace(c.CouponCode) == "":
+		errs.add("/coupon_code", "is required")
+	case len(c.CouponCode) > maxCodeLength:
+		errs.add("/coupon_code", "must be at most %d characters", maxCodeLength)
+	case repository.NormalizeCode(c.CouponCode) == "":
+		errs.add("/coupon_code", "must contain letters or digits")
+	}
+
+	switch {
+	case c.ExpiryDate.IsZero():
+		errs.add("/expiry_date", "is required")
+	case !c.ExpiryDate.After(now):
+		errs.add("/expiry_date", "must be in the future")
+	}
+
+	errs = append(errs, Template(c)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Template validates a template's coupon definition: every rule of Coupon
+// except the code and expiry date, which templates do not carry. It returns
+// nil if the definition is valid.
+func Template(c repository.Coupon) Errors {
+	var errs Errors
+
+	if !c.UsageType.Valid() {
+		errs.add("/usage_type", "must be one of %s, %s, %s", repository.UsageOneTime, repository.UsageMultiUse, repository.UsageTimeBased)
+	}
+
+	if !c.DiscountType.Valid() {
+		errs.add("/discount_type", "must be one of %s, %s", repository.DiscountFixed, repository.DiscountPercentage)
+	}
+
+	switch {
+	case c.DiscountValue <= 0:
+		errs.add("/discount_value", "must be greater than 0")
+	case c.DiscountType == repository.DiscountPercentage && c.DiscountValue > 100:
+		errs.add("/discount_value", "must be at most 100 for percentage discounts")
+	}
+
+	if len(c.ApplicableCategories) == 0 && len(c.ApplicableCategoryIDs) == 0 {
+		errs.add("/applicable_categories", "must list at least one category")
+	}
+	for i, category := range c.ApplicableCategories {
+		if strings.TrimSpace(category) == "" {
+			errs.add(fmt.Sprintf("/applicable_categories/%d", i), "must not be empty")
+		}
+	}
+
+	if c.MinOrderValue < 0 {
+		errs.add("/min_order_value", "must not be negative")
+	}
+	if c.MaxUsagePerUser < 0 {
+		errs.add("/max_usage_per_user", "must not be negative")
+	}
+	if c.MaxDiscount < 0 {
+		errs.add("/max_discount", "must not be negative")
+	}
+	if c.Budget < 0 {
+		errs.add("/budget", "must not be negative")
+	}
+
+	for i, channel := range c.Channels {
+		if !repository.IsValidChannel(channel) {
+			errs.add(fmt.Sprintf("/allowed_channels/%d", i), "must be one of %s, %s, %s", repository.ChannelApp, repository.ChannelWeb, repository.ChannelPOS)
+		}
+	}
+
+	if c.MinAppVersion != "" && !versionPattern.MatchString(c.MinAppVersion) {
+		errs.add("/min_app_version", "must be a dotted version such as 4.2.0")
+	}
+
+	if c.EligibilityRule != "" {
+		if _, err := rules.Cached(c.EligibilityRule); err != nil {
+			errs.add("/eligibility_rule", "%v", err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
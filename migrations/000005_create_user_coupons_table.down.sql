@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_coupons;
\ No newline at end of file
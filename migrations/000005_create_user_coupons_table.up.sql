@@ -0,0 +1,9 @@
+CREATE TABLE user_coupons (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code),
+    max_uses INT NOT NULL,
+    expires_at TIMESTAMP,
+    assigned_at TIMESTAMP NOT NULL,
+    UNIQUE (user_id, coupon_code)
+);
\ No newline at end of file
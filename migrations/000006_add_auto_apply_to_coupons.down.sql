@@ -0,0 +1,3 @@
+ALTER TABLE coupons
+    DROP COLUMN IF EXISTS auto_apply,
+    DROP COLUMN IF EXISTS stackable;
\ No newline at end of file
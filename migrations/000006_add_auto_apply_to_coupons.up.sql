@@ -0,0 +1,3 @@
+ALTER TABLE coupons
+    ADD COLUMN auto_apply BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN stackable BOOLEAN NOT NULL DEFAULT FALSE;
\ No newline at end of file
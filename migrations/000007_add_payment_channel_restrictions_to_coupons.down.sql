@@ -0,0 +1,4 @@
+ALTER TABLE coupons
+    DROP COLUMN IF EXISTS allowed_payment_methods,
+    DROP COLUMN IF EXISTS allowed_channels,
+    DROP COLUMN IF EXISTS min_app_version;
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE coupons
+    ADD COLUMN allowed_payment_methods TEXT,
+    ADD COLUMN allowed_channels TEXT,
+    ADD COLUMN min_app_version VARCHAR(20);
\ No newline at end of file
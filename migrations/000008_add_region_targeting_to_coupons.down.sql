@@ -0,0 +1,5 @@
+ALTER TABLE coupons
+    DROP COLUMN IF EXISTS region_pincodes,
+    DROP COLUMN IF EXISTS region_cities,
+    DROP COLUMN IF EXISTS region_states,
+    DROP COLUMN IF EXISTS region_exclude;
\ No newline at end of file
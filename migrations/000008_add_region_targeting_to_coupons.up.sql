@@ -0,0 +1,5 @@
+ALTER TABLE coupons
+    ADD COLUMN region_pincodes TEXT,
+    ADD COLUMN region_cities TEXT,
+    ADD COLUMN region_states TEXT,
+    ADD COLUMN region_exclude BOOLEAN NOT NULL DEFAULT FALSE;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE coupons DROP COLUMN IF EXISTS eligibility_rule;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE coupons ADD COLUMN eligibility_rule TEXT;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS coupon_version_id;
+DROP TABLE IF EXISTS coupon_versions;
\ No newline at end of file
@@ -0,0 +1,39 @@
+CREATE TABLE coupon_versions (
+    id SERIAL PRIMARY KEY,
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code),
+    version INT NOT NULL,
+    definition JSONB NOT NULL,
+    effective_from TIMESTAMP NOT NULL,
+    UNIQUE (coupon_code, version)
+);
+
+-- Existing coupons become version 1, effective since the beginning
+INSERT INTO coupon_versions (coupon_code, version, definition, effective_from)
+SELECT coupon_code, 1, jsonb_build_object(
+           'coupon_code', coupon_code,
+           'expiry_date', to_char(expiry_date, 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+           'usage_type', usage_type,
+           'applicable_categories', COALESCE(string_to_array(NULLIF(applicable_categories, ''), ','), '{}'),
+           'min_order_value', min_order_value,
+           'discount_type', discount_type,
+           'discount_value', discount_value,
+           'max_usage_per_user', max_usage_per_user,
+           'auto_apply', auto_apply,
+           'stackable', stackable,
+           'allowed_payment_methods', string_to_array(NULLIF(allowed_payment_methods, ''), ','),
+           'allowed_channels', string_to_array(NULLIF(allowed_channels, ''), ','),
+           'min_app_version', min_app_version,
+           'region', jsonb_build_object(
+               'pincodes', string_to_array(NULLIF(region_pincodes, ''), ','),
+               'cities', string_to_array(NULLIF(region_cities, ''), ','),
+               'states', string_to_array(NULLIF(region_states, ''), ','),
+               'exclude', region_exclude),
+           'eligibility_rule', eligibility_rule),
+       'epoch'
+FROM coupons;
+
+ALTER TABLE orders ADD COLUMN coupon_version_id INT REFERENCES coupon_versions(id);
+
+UPDATE orders o SET coupon_version_id = v.id
+FROM coupon_versions v
+WHERE v.coupon_code = o.coupon_code_used;
\ No newline at end of file
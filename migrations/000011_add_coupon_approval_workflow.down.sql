@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS coupon_status_transitions;
+
+ALTER TABLE coupons
+    DROP COLUMN IF EXISTS max_discount,
+    DROP COLUMN IF EXISTS budget,
+    DROP COLUMN IF EXISTS status;
\ No newline at end of file
@@ -0,0 +1,17 @@
+ALTER TABLE coupons
+    ADD COLUMN max_discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN budget DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'live';
+
+-- Existing coupons stay live; new coupons start as drafts
+ALTER TABLE coupons ALTER COLUMN status SET DEFAULT 'draft';
+
+CREATE TABLE coupon_status_transitions (
+    id SERIAL PRIMARY KEY,
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code),
+    from_status VARCHAR(20) NOT NULL,
+    to_status VARCHAR(20) NOT NULL,
+    actor VARCHAR(100) NOT NULL,
+    note TEXT,
+    created_at TIMESTAMP NOT NULL
+);
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS coupon_templates;
\ No newline at end of file
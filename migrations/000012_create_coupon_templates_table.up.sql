@@ -0,0 +1,5 @@
+CREATE TABLE coupon_templates (
+    name VARCHAR(100) PRIMARY KEY,
+    definition JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
\ No newline at end of file
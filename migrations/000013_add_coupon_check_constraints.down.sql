@@ -0,0 +1,10 @@
+ALTER TABLE coupons
+    DROP CONSTRAINT IF EXISTS coupons_coupon_code_check,
+    DROP CONSTRAINT IF EXISTS coupons_usage_type_check,
+    DROP CONSTRAINT IF EXISTS coupons_discount_type_check,
+    DROP CONSTRAINT IF EXISTS coupons_discount_value_check,
+    DROP CONSTRAINT IF EXISTS coupons_min_order_value_check,
+    DROP CONSTRAINT IF EXISTS coupons_max_usage_per_user_check,
+    DROP CONSTRAINT IF EXISTS coupons_max_discount_check,
+    DROP CONSTRAINT IF EXISTS coupons_budget_check,
+    DROP CONSTRAINT IF EXISTS coupons_status_check;
@@ -0,0 +1,11 @@
+-- NOT VALID keeps existing rows loadable; new and updated rows are checked.
+ALTER TABLE coupons
+    ADD CONSTRAINT coupons_coupon_code_check CHECK (coupon_code <> '') NOT VALID,
+    ADD CONSTRAINT coupons_usage_type_check CHECK (usage_type IN ('one-time', 'multi-use', 'time-based')) NOT VALID,
+    ADD CONSTRAINT coupons_discount_type_check CHECK (discount_type IN ('fixed', 'percentage')) NOT VALID,
+    ADD CONSTRAINT coupons_discount_value_check CHECK (discount_value > 0 AND (discount_type <> 'percentage' OR discount_value <= 100)) NOT VALID,
+    ADD CONSTRAINT coupons_min_order_value_check CHECK (min_order_value >= 0) NOT VALID,
+    ADD CONSTRAINT coupons_max_usage_per_user_check CHECK (max_usage_per_user >= 0) NOT VALID,
+    ADD CONSTRAINT coupons_max_discount_check CHECK (max_discount >= 0) NOT VALID,
+    ADD CONSTRAINT coupons_budget_check CHECK (budget >= 0) NOT VALID,
+    ADD CONSTRAINT coupons_status_check CHECK (status IN ('draft', 'pending_approval', 'approved', 'rejected', 'live')) NOT VALID;
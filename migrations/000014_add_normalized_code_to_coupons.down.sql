@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS coupons_normalized_code_key;
+
+ALTER TABLE coupons DROP COLUMN IF EXISTS normalized_code;
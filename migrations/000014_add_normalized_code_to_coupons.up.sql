@@ -0,0 +1,28 @@
+-- Codes are matched on their normalized form: upper case with whitespace and
+-- the separators - _ . removed. coupon_code keeps the display form.
+ALTER TABLE coupons ADD COLUMN normalized_code VARCHAR(50);
+
+-- The exact rules of NormalizeCode: only ASCII whitespace and the separators
+-- are removed, and only ASCII letters are upper-cased. UPPER and [[:space:]]
+-- depend on the database locale and could fold codes differently.
+UPDATE coupons SET normalized_code = TRANSLATE(REGEXP_REPLACE(coupon_code, '[ \t\n\v\f\r_.-]', '', 'g'),
+                                               'abcdefghijklmnopqrstuvwxyz', 'ABCDEFGHIJKLMNOPQRSTUVWXYZ');
+
+-- Existing codes that only differ by case or separators must be renamed by
+-- hand before the unique index can be created.
+DO $$
+DECLARE
+    collisions TEXT;
+BEGIN
+    SELECT STRING_AGG(codes, '; ') INTO collisions
+    FROM (SELECT STRING_AGG(coupon_code, ', ' ORDER BY coupon_code) AS codes
+          FROM coupons GROUP BY normalized_code HAVING COUNT(*) > 1) c;
+
+    IF collisions IS NOT NULL THEN
+        RAISE EXCEPTION 'coupon codes collide once normalized: %', collisions;
+    END IF;
+END $$;
+
+ALTER TABLE coupons ALTER COLUMN normalized_code SET NOT NULL;
+
+CREATE UNIQUE INDEX coupons_normalized_code_key ON coupons (normalized_code);
@@ -0,0 +1,10 @@
+CREATE TABLE failed_attempts (
+    key VARCHAR(200) PRIMARY KEY,
+    failures INT NOT NULL,
+    last_failure TIMESTAMP NOT NULL,
+    -- The last failure before the latest one, so that an attempt counted up
+    -- front can be taken back
+    previous_failure TIMESTAMP
+);
+
+CREATE INDEX failed_attempts_last_failure_idx ON failed_attempts (last_failure);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS flagged_redemptions;
+DROP TABLE IF EXISTS redemption_signals;
@@ -0,0 +1,28 @@
+-- Hashed device, phone and address signals seen on coupon redemptions
+CREATE TABLE redemption_signals (
+    user_id INT NOT NULL REFERENCES users(id),
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code),
+    kind VARCHAR(20) NOT NULL,
+    value CHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, coupon_code, kind, value)
+);
+
+CREATE INDEX redemption_signals_value_idx ON redemption_signals (kind, value, created_at);
+
+CREATE TABLE flagged_redemptions (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code),
+    blocked BOOLEAN NOT NULL,
+    linked_accounts INT[] NOT NULL,
+    velocity INT NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    reviewed_by VARCHAR(100),
+    review_note TEXT,
+    created_at TIMESTAMP NOT NULL,
+    reviewed_at TIMESTAMP,
+    UNIQUE (user_id, coupon_code)
+);
+
+CREATE INDEX flagged_redemptions_status_idx ON flagged_redemptions (status, created_at);
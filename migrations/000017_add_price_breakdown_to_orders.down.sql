@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS order_coupons;
+
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS subtotal,
+    DROP COLUMN IF EXISTS items_discount,
+    DROP COLUMN IF EXISTS charges_discount;
@@ -0,0 +1,29 @@
+ALTER TABLE orders
+    ADD COLUMN subtotal DECIMAL(10, 2),
+    ADD COLUMN items_discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN charges_discount DECIMAL(10, 2) NOT NULL DEFAULT 0;
+
+-- The discount on earlier orders was not recorded
+UPDATE orders SET subtotal = amount_paid;
+
+ALTER TABLE orders ALTER COLUMN subtotal SET NOT NULL;
+
+-- Every coupon an order redeemed: the entered one and the automatic
+-- promotions applied alongside it. orders.coupon_code_used keeps the entered
+-- code.
+CREATE TABLE order_coupons (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(id),
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code),
+    auto_applied BOOLEAN NOT NULL DEFAULT FALSE,
+    items_discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    charges_discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    coupon_version_id INT REFERENCES coupon_versions(id),
+    UNIQUE (order_id, coupon_code)
+);
+
+CREATE INDEX order_coupons_coupon_code_idx ON order_coupons (coupon_code);
+
+INSERT INTO order_coupons (order_id, coupon_code, coupon_version_id)
+SELECT id, coupon_code_used, coupon_version_id
+FROM orders WHERE coupon_code_used IS NOT NULL;
@@ -0,0 +1,13 @@
+-- Name and category are copied from the catalog as they were when ordered
+CREATE TABLE order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(id),
+    item_id INT NOT NULL REFERENCES items(id),
+    name VARCHAR(100) NOT NULL,
+    category VARCHAR(100) NOT NULL,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    unit_price DECIMAL(10, 2) NOT NULL,
+    line_discount DECIMAL(10, 2) NOT NULL DEFAULT 0
+);
+
+CREATE INDEX order_items_order_id_idx ON order_items (order_id);
@@ -0,0 +1,5 @@
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_order_status_check;
+
+ALTER TABLE orders ALTER COLUMN order_status DROP DEFAULT;
+
+DROP TABLE IF EXISTS order_status_history;
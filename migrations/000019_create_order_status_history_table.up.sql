@@ -0,0 +1,23 @@
+CREATE TABLE order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(id),
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    actor VARCHAR(100) NOT NULL,
+    note TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX order_status_history_order_id_idx ON order_status_history (order_id);
+
+-- Statuses used to be free-form; existing orders keep theirs, but only
+-- known statuses can be written from now on.
+UPDATE orders SET order_status = LOWER(TRIM(order_status));
+
+INSERT INTO order_status_history (order_id, to_status, actor, created_at)
+SELECT id, order_status, 'system', ordered_at FROM orders;
+
+ALTER TABLE orders ALTER COLUMN order_status SET DEFAULT 'pending';
+
+ALTER TABLE orders ADD CONSTRAINT orders_order_status_check
+    CHECK (order_status IN ('pending', 'paid', 'packed', 'shipped', 'delivered', 'cancelled', 'returned')) NOT VALID;
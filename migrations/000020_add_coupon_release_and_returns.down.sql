@@ -0,0 +1,11 @@
+ALTER TABLE order_items DROP COLUMN IF EXISTS returned_quantity;
+
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS refunded_amount,
+    DROP COLUMN IF EXISTS discount_clawback;
+
+ALTER TABLE order_coupons
+    DROP COLUMN IF EXISTS released_at,
+    DROP COLUMN IF EXISTS min_order_clawed_back;
+
+ALTER TABLE coupons DROP COLUMN IF EXISTS consume_on_cancel;
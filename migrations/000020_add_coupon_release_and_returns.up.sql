@@ -0,0 +1,20 @@
+ALTER TABLE coupons ADD COLUMN consume_on_cancel BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- An order's coupon use no longer counts once released by a cancellation or
+-- full refund. A coupon's discount on the kept items is taken back once when
+-- a return leaves the order under the coupon's minimum order value.
+ALTER TABLE order_coupons
+    ADD COLUMN released_at TIMESTAMP,
+    ADD COLUMN min_order_clawed_back BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE orders
+    ADD COLUMN refunded_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN discount_clawback DECIMAL(10, 2) NOT NULL DEFAULT 0;
+
+ALTER TABLE order_items ADD COLUMN returned_quantity INT NOT NULL DEFAULT 0;
+
+-- Orders already cancelled or returned release their coupons, as they would
+-- have under the default
+UPDATE order_coupons oc SET released_at = NOW()
+FROM orders o
+WHERE o.id = oc.order_id AND o.order_status IN ('cancelled', 'returned');
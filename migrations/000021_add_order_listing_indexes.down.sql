@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS orders_user_id_ordered_at_id_idx;
+DROP INDEX IF EXISTS orders_ordered_at_id_idx;
@@ -0,0 +1,3 @@
+-- Keyset pagination walks orders newest first, overall and per user
+CREATE INDEX orders_ordered_at_id_idx ON orders (ordered_at DESC, id DESC);
+CREATE INDEX orders_user_id_ordered_at_id_idx ON orders (user_id, ordered_at DESC, id DESC);
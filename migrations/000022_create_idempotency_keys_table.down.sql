@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS orders_user_id_idempotency_key_idx;
+ALTER TABLE orders DROP COLUMN IF EXISTS idempotency_key;
+
+DROP TABLE IF EXISTS idempotency_keys;
@@ -0,0 +1,18 @@
+CREATE TABLE idempotency_keys (
+    scope VARCHAR(50) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INT,
+    content_type VARCHAR(100),
+    response BYTEA,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+
+-- Ties an order to the Idempotency-Key it was placed with, so that a retry
+-- finds it even if its response was never stored
+ALTER TABLE orders ADD COLUMN idempotency_key VARCHAR(255);
+
+CREATE INDEX orders_user_id_idempotency_key_idx ON orders (user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
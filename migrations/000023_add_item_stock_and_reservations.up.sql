@@ -0,0 +1,12 @@
+-- NULL stock means the item's stock is not tracked and it never runs out
+ALTER TABLE items ADD COLUMN stock INT CHECK (stock >= 0);
+
+CREATE TABLE stock_reservations (
+    user_id INT NOT NULL REFERENCES users(id),
+    item_id INT NOT NULL REFERENCES items(id),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, item_id)
+);
+
+CREATE INDEX stock_reservations_item_id_idx ON stock_reservations (item_id, expires_at);
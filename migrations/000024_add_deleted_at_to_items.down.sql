@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS items_name_idx;
+DROP INDEX IF EXISTS items_price_idx;
+ALTER TABLE items DROP COLUMN IF EXISTS deleted_at;
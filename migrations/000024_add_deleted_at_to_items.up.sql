@@ -0,0 +1,5 @@
+-- Deleted items stay referenced by past orders, coupons and reservations
+ALTER TABLE items ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX items_price_idx ON items (price, id) WHERE deleted_at IS NULL;
+CREATE INDEX items_name_idx ON items (COALESCE(name, ''), id) WHERE deleted_at IS NULL;
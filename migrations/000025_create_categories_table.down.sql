@@ -0,0 +1,4 @@
+ALTER TABLE coupons DROP COLUMN IF EXISTS applicable_category_ids;
+DROP INDEX IF EXISTS items_category_id_idx;
+ALTER TABLE items DROP COLUMN IF EXISTS category_id;
+DROP TABLE IF EXISTS categories;
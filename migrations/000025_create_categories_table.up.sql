@@ -0,0 +1,54 @@
+CREATE TABLE categories (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    parent_id INT REFERENCES categories(id),
+    -- Names from the top-level category down, e.g. 'Pain Relief > Topical'
+    path VARCHAR(500) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX categories_path_idx ON categories (LOWER(path));
+CREATE INDEX categories_parent_id_idx ON categories (parent_id);
+
+-- Existing free-text categories become top-level categories, merging those
+-- that only differ in case
+INSERT INTO categories (name, path)
+SELECT MIN(name), MIN(name)
+FROM (
+    SELECT TRIM(category) AS name FROM items
+    UNION
+    SELECT TRIM(UNNEST(string_to_array(applicable_categories, ','))) FROM coupons
+) existing
+WHERE name <> ''
+GROUP BY LOWER(name);
+
+INSERT INTO categories (name, path)
+SELECT 'Uncategorized', 'Uncategorized'
+WHERE EXISTS (SELECT 1 FROM items WHERE TRIM(category) = '')
+  AND NOT EXISTS (SELECT 1 FROM categories WHERE LOWER(path) = 'uncategorized');
+
+-- items.category keeps the category's path for display
+ALTER TABLE items ALTER COLUMN category TYPE VARCHAR(500);
+ALTER TABLE order_items ALTER COLUMN category TYPE VARCHAR(500);
+ALTER TABLE items ADD COLUMN category_id INT REFERENCES categories(id);
+
+UPDATE items i SET category_id = c.id, category = c.path
+FROM categories c
+WHERE LOWER(c.path) = LOWER(COALESCE(NULLIF(TRIM(i.category), ''), 'Uncategorized'));
+
+ALTER TABLE items ALTER COLUMN category_id SET NOT NULL;
+CREATE INDEX items_category_id_idx ON items (category_id);
+
+-- applicable_categories keeps the paths of the categories in
+-- applicable_category_ids, in the same order
+ALTER TABLE coupons ADD COLUMN applicable_category_ids INT[] NOT NULL DEFAULT '{}';
+
+UPDATE coupons co SET
+    applicable_category_ids = ARRAY(
+        SELECT c.id FROM UNNEST(string_to_array(co.applicable_categories, ',')) WITH ORDINALITY AS a(name, n)
+        JOIN categories c ON LOWER(c.path) = LOWER(TRIM(a.name))
+        ORDER BY a.n),
+    applicable_categories = ARRAY_TO_STRING(ARRAY(
+        SELECT c.path FROM UNNEST(string_to_array(co.applicable_categories, ',')) WITH ORDINALITY AS a(name, n)
+        JOIN categories c ON LOWER(c.path) = LOWER(TRIM(a.name))
+        ORDER BY a.n), ',');
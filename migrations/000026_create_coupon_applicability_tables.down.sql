@@ -0,0 +1,15 @@
+ALTER TABLE coupons ADD COLUMN applicable_medicine_ids TEXT;
+ALTER TABLE coupons ADD COLUMN applicable_categories TEXT;
+ALTER TABLE coupons ADD COLUMN applicable_category_ids INT[] NOT NULL DEFAULT '{}';
+
+UPDATE coupons co SET
+    applicable_category_ids = ARRAY(
+        SELECT cc.category_id FROM coupon_categories cc WHERE cc.coupon_code = co.coupon_code ORDER BY cc.position),
+    applicable_categories = ARRAY_TO_STRING(ARRAY(
+        SELECT c.path FROM coupon_categories cc JOIN categories c ON c.id = cc.category_id
+        WHERE cc.coupon_code = co.coupon_code ORDER BY cc.position), ','),
+    applicable_medicine_ids = NULLIF(ARRAY_TO_STRING(ARRAY(
+        SELECT ci.item_id FROM coupon_items ci WHERE ci.coupon_code = co.coupon_code ORDER BY ci.position), ','), '');
+
+DROP TABLE IF EXISTS coupon_items;
+DROP TABLE IF EXISTS coupon_categories;
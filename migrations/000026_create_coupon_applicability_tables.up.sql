@@ -0,0 +1,35 @@
+-- The categories and items a coupon applies to, in the order they were listed
+CREATE TABLE coupon_categories (
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code) ON DELETE CASCADE,
+    category_id INT NOT NULL REFERENCES categories(id),
+    position INT NOT NULL,
+    PRIMARY KEY (coupon_code, category_id)
+);
+
+CREATE INDEX coupon_categories_category_id_idx ON coupon_categories (category_id);
+
+CREATE TABLE coupon_items (
+    coupon_code VARCHAR(50) NOT NULL REFERENCES coupons(coupon_code) ON DELETE CASCADE,
+    item_id INT NOT NULL REFERENCES items(id),
+    position INT NOT NULL,
+    PRIMARY KEY (coupon_code, item_id)
+);
+
+CREATE INDEX coupon_items_item_id_idx ON coupon_items (item_id);
+
+INSERT INTO coupon_categories (coupon_code, category_id, position)
+SELECT co.coupon_code, a.id, a.n
+FROM coupons co CROSS JOIN LATERAL UNNEST(co.applicable_category_ids) WITH ORDINALITY AS a(id, n)
+ON CONFLICT DO NOTHING;
+
+-- Ids that do not name an existing item are dropped
+INSERT INTO coupon_items (coupon_code, item_id, position)
+SELECT co.coupon_code, i.id, a.n
+FROM coupons co
+CROSS JOIN LATERAL UNNEST(string_to_array(co.applicable_medicine_ids, ',')) WITH ORDINALITY AS a(id, n)
+JOIN items i ON i.id::text = TRIM(a.id)
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE coupons DROP COLUMN applicable_categories;
+ALTER TABLE coupons DROP COLUMN applicable_category_ids;
+ALTER TABLE coupons DROP COLUMN applicable_medicine_ids;